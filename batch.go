@@ -0,0 +1,277 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// queueEntry is a single item in a batch queue file.
+// Blank values fall back to the global options.
+type queueEntry struct {
+	Code       string `yaml:"code" json:"code"`
+	FileName   string `yaml:"filename" json:"filename"`
+	Resolution string `yaml:"resolution" json:"resolution"`
+	Format     string `yaml:"format" json:"format"`
+	Folder     string `yaml:"folder" json:"folder"`
+	HardSubs   *bool  `yaml:"hardsubs" json:"hardsubs"`
+	Series     string `yaml:"series" json:"series"`
+	Season     *int   `yaml:"season" json:"season"`
+	Episode    *int   `yaml:"episode" json:"episode"`
+	Title      string `yaml:"title" json:"title"`
+	Date       string `yaml:"date" json:"date"`
+	AudioLang  string `yaml:"audio_lang" json:"audio_lang"`
+	SubLang    string `yaml:"sub_lang" json:"sub_lang"`
+}
+
+// toJob creates a job from the entry, using defaults for unset values
+func (e queueEntry) toJob(defaults kdramadl.Job) kdramadl.Job {
+	j := defaults
+	j.Code = strings.TrimSpace(e.Code)
+	j.FileName = strings.TrimSpace(e.FileName)
+	if e.Resolution != "" {
+		j.Resolution = strings.TrimSpace(e.Resolution)
+	}
+	if e.Format != "" {
+		j.Format = strings.TrimSpace(e.Format)
+	}
+	if e.Folder != "" {
+		j.Folder = e.Folder
+	}
+	if e.HardSubs != nil {
+		j.HardSubs = *e.HardSubs
+	}
+	return j
+}
+
+// metadata returns the metadata of the entry, using defaults for unset values
+func (e queueEntry) metadata(defaults metadata) metadata {
+	m := defaults
+	m.FileName = strings.TrimSpace(e.FileName)
+	if e.Series != "" {
+		m.Series = strings.TrimSpace(e.Series)
+	}
+	if e.Season != nil {
+		m.Season = e.Season
+	}
+	if e.Episode != nil {
+		m.Episode = e.Episode
+	}
+	// the title is per episode, so it does not default to --title
+	m.Title = strings.TrimSpace(e.Title)
+	if e.Date != "" {
+		m.Date = strings.TrimSpace(e.Date)
+	}
+	if e.AudioLang != "" {
+		m.AudioLanguage = strings.TrimSpace(e.AudioLang)
+	}
+	if e.SubLang != "" {
+		m.SubtitleLanguage = strings.TrimSpace(e.SubLang)
+	}
+	return m
+}
+
+// checkOutputPaths returns an error for each job in a queue that writes
+// a file an earlier job also writes: the video, or the subtitles if the
+// format keeps them or only subtitles are downloaded. The later job would
+// otherwise overwrite or be renamed because of the earlier one. Jobs
+// without a filename are left to Job.Validate.
+func checkOutputPaths(queue []kdramadl.Job, subFormat string, subOnly bool) []error {
+	if subFormat == "" {
+		subFormat = kdramadl.SubtitleFormats[0]
+	}
+	errs := make([]error, len(queue))
+	seen := make(map[string]int)
+	for i, j := range queue {
+		if j.FileName == "" {
+			continue
+		}
+		base, err := filepath.Abs(filepath.Join(j.Folder, j.FileName))
+		if err != nil {
+			continue
+		}
+		format := j.Format
+		if format == "" {
+			format = kdramadl.Formats[0]
+		}
+		var paths []string
+		if !subOnly {
+			paths = append(paths, base+"."+format)
+		}
+		if subOnly || kdramadl.KeepsSubtitles(format) {
+			paths = append(paths, base+"."+subFormat)
+		}
+		for _, path := range paths {
+			if first, ok := seen[path]; ok {
+				errs[i] = fmt.Errorf("Entry %v is also saved as %v", first+1, path)
+				break
+			}
+		}
+		if errs[i] == nil {
+			for _, path := range paths {
+				seen[path] = i
+			}
+		}
+	}
+	return errs
+}
+
+// readQueue loads queue entries from a .yml/.yaml, .csv or .jsonl file
+func readQueue(queueFile string) ([]queueEntry, error) {
+	f, err := os.Open(queueFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []queueEntry
+	switch strings.ToLower(filepath.Ext(queueFile)) {
+	case ".yml", ".yaml":
+		entries, err = readYamlQueue(f)
+	case ".csv":
+		entries, err = readCsvQueue(f)
+	case ".jsonl", ".ndjson", ".json":
+		entries, err = readJSONLinesQueue(f)
+	default:
+		return nil, fmt.Errorf("Unsupported queue file type: %v", queueFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %v: %v", queueFile, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("No entries found in %v", queueFile)
+	}
+	return entries, nil
+}
+
+// readYamlQueue parses a yaml list of entries
+func readYamlQueue(r io.Reader) ([]queueEntry, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []queueEntry
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readCsvQueue parses a csv file where the first row is the header
+func readCsvQueue(r io.Reader) ([]queueEntry, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.Comment = '#'
+	csvReader.TrimLeadingSpace = true
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 1 {
+		return nil, nil
+	}
+
+	header := rows[0]
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+	var entries []queueEntry
+	for n, row := range rows[1:] {
+		var entry queueEntry
+		for i, value := range row {
+			switch header[i] {
+			case "code":
+				entry.Code = value
+			case "filename":
+				entry.FileName = value
+			case "resolution":
+				entry.Resolution = value
+			case "format":
+				entry.Format = value
+			case "folder":
+				entry.Folder = value
+			case "hardsubs":
+				if value == "" {
+					continue
+				}
+				hardSubs, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("row %v: invalid hardsubs value %q", n+2, value)
+				}
+				entry.HardSubs = &hardSubs
+			case "series":
+				entry.Series = value
+			case "title":
+				entry.Title = value
+			case "date":
+				entry.Date = value
+			case "audio_lang":
+				entry.AudioLang = value
+			case "sub_lang":
+				entry.SubLang = value
+			case "season", "episode":
+				number, err := parseNumber(header[i], value)
+				if err != nil {
+					return nil, fmt.Errorf("row %v: %v", n+2, err)
+				}
+				if header[i] == "season" {
+					entry.Season = number
+				} else {
+					entry.Episode = number
+				}
+			default:
+				return nil, fmt.Errorf("unknown column %q", header[i])
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// readJSONLinesQueue parses one json object per line.
+// Blank lines and lines starting with # are ignored.
+func readJSONLinesQueue(r io.Reader) ([]queueEntry, error) {
+	var entries []queueEntry
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var entry queueEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNo, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+func TestCheckOutputPaths(t *testing.T) {
+	queue := []kdramadl.Job{
+		{FileName: "ep1", Format: kdramadl.FormatMKV},
+		{FileName: "ep1", Format: kdramadl.FormatM4A}, // other extension
+		{FileName: "ep1", Format: kdramadl.FormatMKV}, // same video
+		{FileName: "ep2", Format: kdramadl.FormatMP4},
+		{FileName: "ep2", Format: kdramadl.FormatMOV}, // same subtitles
+		{FileName: "ep2", Format: kdramadl.FormatMKV}, // keeps no subtitles
+		{FileName: "ep3", Format: kdramadl.FormatMKV, Folder: "other"},
+		{FileName: "ep3", Format: kdramadl.FormatMKV},
+		{FileName: "", Format: kdramadl.FormatMKV},
+		{FileName: "", Format: kdramadl.FormatMKV},
+	}
+	wantFailed := map[int]bool{2: true, 4: true}
+	for i, err := range checkOutputPaths(queue, "", false) {
+		if (err != nil) != wantFailed[i] {
+			t.Errorf("entry %v: got error %v, want one: %v", i+1, err, wantFailed[i])
+		}
+	}
+
+	// only the subtitles are saved, so every format of an episode collides
+	wantFailed = map[int]bool{1: true, 2: true, 4: true, 5: true}
+	for i, err := range checkOutputPaths(queue, kdramadl.SubtitleVTT, true) {
+		if (err != nil) != wantFailed[i] {
+			t.Errorf("subtitles only, entry %v: got error %v, want one: %v", i+1, err, wantFailed[i])
+		}
+	}
+}
+
+func TestReadQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	one, three, yes := 1, 3, true
+	want := []queueEntry{
+		{Code: "abc", FileName: "Goblin E01", Resolution: "720p", Format: "mp4", HardSubs: &yes,
+			Series: "Goblin", Season: &one, Episode: &three},
+		{Code: "def", FileName: "Goblin E02"},
+	}
+	tests := []struct {
+		name, file, content string
+		err                 string
+	}{
+		{"yaml", "queue.yml", `
+- code: abc
+  filename: Goblin E01
+  resolution: 720p
+  format: mp4
+  hardsubs: true
+  series: Goblin
+  season: 1
+  episode: 3
+- code: def
+  filename: Goblin E02
+`, ""},
+		{"csv", "queue.csv", `Code, FileName, Resolution, Format, HardSubs, Series, Season, Episode
+# the first episode
+abc, Goblin E01, 720p, mp4, true, Goblin, 1, 3
+def, Goblin E02, , , , , ,
+`, ""},
+		{"jsonl", "queue.jsonl", `{"code": "abc", "filename": "Goblin E01", "resolution": "720p", "format": "mp4", "hardsubs": true, "series": "Goblin", "season": 1, "episode": 3}
+
+# the second episode
+{"code": "def", "filename": "Goblin E02"}
+`, ""},
+		{"csv header only", "header.csv", "code,filename\n", "No entries found"},
+		{"csv empty", "empty.csv", "", "No entries found"},
+		{"csv unknown column", "column.csv", "code,name\nabc,ep1\n", `unknown column "name"`},
+		{"csv invalid hardsubs", "hardsubs.csv", "code,hardsubs\nabc,true\ndef,maybe\n", "row 3: invalid hardsubs"},
+		{"csv invalid episode", "episode.csv", "code,episode\nabc,-1\n", "row 2: Invalid episode number"},
+		{"csv short row", "short.csv", "code,filename\nabc\n", "wrong number of fields"},
+		{"jsonl malformed line", "bad.jsonl", "{\"code\": \"abc\"}\n\n{\"code\": \"def\",\n", "line 3"},
+		{"jsonl only comments", "comments.jsonl", "# nothing yet\n", "No entries found"},
+		{"yaml not a list", "map.yaml", "code: abc\n", "Error reading"},
+		{"unsupported type", "queue.txt", "abc\n", "Unsupported queue file type"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.file)
+			if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readQueue(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, want) {
+				t.Errorf("got %+v, want %+v", entries, want)
+			}
+		})
+	}
+	if _, err := readQueue(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Error("no error for a missing queue file")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseClip parses the --start, --end and --duration options into the
+// start and end of a clip. The end is 0 if the clip runs to the end.
+func parseClip(start, end, duration string) (time.Duration, time.Duration, error) {
+	clipStart, err := parseTimestamp("start", start)
+	if err != nil {
+		return 0, 0, err
+	}
+	clipEnd, err := parseTimestamp("end", end)
+	if err != nil {
+		return 0, 0, err
+	}
+	clipLength, err := parseTimestamp("duration", duration)
+	if err != nil {
+		return 0, 0, err
+	}
+	if clipEnd > 0 && clipLength > 0 {
+		return 0, 0, errors.New("Use either --end or --duration")
+	}
+	if clipLength > 0 {
+		clipEnd = clipStart + clipLength
+	}
+	if clipEnd > 0 && clipEnd <= clipStart {
+		return 0, 0, fmt.Errorf("The clip must end after %v", clipStart)
+	}
+	return clipStart, clipEnd, nil
+}
+
+// parseTimestamp parses a time in the video such as "1:02:03.5", "12:30",
+// "90" seconds or "1m30s"
+func parseTimestamp(name, s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if t, err := time.ParseDuration(s); err == nil && t >= 0 {
+		return t, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("Invalid %v: %v", name, s)
+	}
+	var t time.Duration
+	for i, part := range parts {
+		last := i == len(parts)-1
+		var value float64
+		var err error
+		if last {
+			value, err = strconv.ParseFloat(part, 64)
+		} else {
+			var n int
+			n, err = strconv.Atoi(part)
+			value = float64(n)
+		}
+		if err != nil || value < 0 || (i > 0 && value >= 60) {
+			return 0, fmt.Errorf("Invalid %v: %v", name, s)
+		}
+		t = t*60 + time.Duration(value*float64(time.Second))
+	}
+	return t, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fileConfig holds the sections of the config file that are not options
+type fileConfig struct {
+	Providers map[string]*kdramadl.TemplateProvider `yaml:"providers"`
+	Profiles  map[string]*kdramadl.Profile          `yaml:"profiles"`
+}
+
+// readConfig loads the config file. A missing file gives an empty config.
+func readConfig(configFile string) (*fileConfig, error) {
+	config := &fileConfig{}
+	if configFile == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Error reading %v: %v", configFile, err)
+	}
+	return config, nil
+}
+
+// provider returns the built-in provider or one defined in the config file
+func (config *fileConfig) provider(name string) (kdramadl.Provider, error) {
+	if p, ok := config.Providers[name]; ok {
+		if err := p.Check(); err != nil {
+			return nil, fmt.Errorf("Invalid provider %v: %v", name, err)
+		}
+		return p, nil
+	}
+	if name == "" || name == "goplay" {
+		return kdramadl.GoPlay, nil
+	}
+	return nil, fmt.Errorf("Unknown provider: %v", name)
+}
+
+// profile returns an encoding profile defined in the config file, or nil
+// if name is blank
+func (config *fileConfig) profile(name string) (*kdramadl.Profile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := config.Profiles[name]
+	if !ok || p == nil {
+		return nil, fmt.Errorf("Unknown profile: %v", name)
+	}
+	if err := p.Check(); err != nil {
+		return nil, fmt.Errorf("Invalid profile %v: %v", name, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+// historyEntry records a completed download
+type historyEntry struct {
+	Code       string    `json:"code"`
+	FileName   string    `json:"filename"`
+	Resolution string    `json:"resolution"`
+	Format     string    `json:"format"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Time       time.Time `json:"downloaded"`
+}
+
+// downloadHistory is the list of completed downloads kept in a json file
+type downloadHistory struct {
+	path    string
+	mutex   sync.Mutex
+	entries []historyEntry
+}
+
+// defaultHistoryPath returns history.json in the user's config folder
+func defaultHistoryPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "kdramadl_history.json"
+	}
+	return filepath.Join(configDir, "kdramadl", "history.json")
+}
+
+// openHistory loads the history file. A missing file gives an empty history.
+func openHistory(path string) (*downloadHistory, error) {
+	h := &downloadHistory{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		return nil, fmt.Errorf("Error reading %v: %v", path, err)
+	}
+	return h, nil
+}
+
+// find returns the entry for a job that was downloaded before.
+// A job for the best or worst resolution matches any resolution.
+func (h *downloadHistory) find(j kdramadl.Job) (historyEntry, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if e.Code != j.Code || e.Format != j.Format {
+			continue
+		}
+		if e.Resolution == j.Resolution ||
+			j.Resolution == kdramadl.ResolutionBest || j.Resolution == kdramadl.ResolutionWorst {
+			return e, true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// add records a completed download and saves the history
+func (h *downloadHistory) add(j kdramadl.Job, result *kdramadl.VideoResult) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.entries = append(h.entries, historyEntry{
+		Code:       j.Code,
+		FileName:   j.FileName,
+		Resolution: j.Resolution,
+		Format:     j.Format,
+		Path:       result.Path,
+		Size:       result.Size,
+		SHA256:     result.SHA256,
+		Time:       time.Now().UTC(),
+	})
+	return h.save()
+}
+
+// forget removes the entries for a code and returns how many were removed
+func (h *downloadHistory) forget(code string) (int, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var kept []historyEntry
+	for _, e := range h.entries {
+		if e.Code != code {
+			kept = append(kept, e)
+		}
+	}
+	removed := len(h.entries) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	h.entries = kept
+	return removed, h.save()
+}
+
+// save writes the history to a temporary file first so that an
+// interrupted save does not lose it
+func (h *downloadHistory) save() error {
+	if err := os.MkdirAll(filepath.Dir(h.path), os.ModePerm); err != nil {
+		return err
+	}
+	entries := h.entries
+	if entries == nil {
+		entries = []historyEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, h.path)
+}
+
+// showHistory prints the entries as a table, or as json in json mode
+func showHistory(h *downloadHistory) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if outputMode == outputJSON {
+		for _, e := range h.entries {
+			emit(historyEvent{eventHeader: newEventHeader(eventHistory, nil), historyEntry: e})
+		}
+		return
+	}
+	if len(h.entries) == 0 {
+		fmt.Println("No downloads yet")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Downloaded\tCode\tResolution\tFormat\tSize\tPath\n")
+	for _, e := range h.entries {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			e.Time.Local().Format("2006-01-02 15:04"), e.Code, e.Resolution, e.Format,
+			formatBytes(e.Size), e.Path)
+	}
+	w.Flush()
+}
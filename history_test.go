@@ -0,0 +1,199 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+// setEnv sets environment variables and returns a function that restores them
+func setEnv(vars map[string]string) func() {
+	old := map[string]*string{}
+	for name, value := range vars {
+		if v, ok := os.LookupEnv(name); ok {
+			old[name] = &v
+		} else {
+			old[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, value := range old {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setEnv(map[string]string{"XDG_CONFIG_HOME": dir, "HOME": dir, "AppData": dir})()
+
+	path := defaultHistoryPath()
+	if !strings.HasPrefix(path, dir) {
+		t.Fatalf("history at %v, want it in %v", path, dir)
+	}
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep1 := kdramadl.Job{Code: "abc", FileName: "ep1", Resolution: "720p", Format: kdramadl.FormatMKV}
+	ep2 := kdramadl.Job{Code: "def", FileName: "ep2", Resolution: "1080p", Format: kdramadl.FormatMP4}
+	for _, j := range []kdramadl.Job{ep1, ep2, ep1} {
+		if err := h.add(j, &kdramadl.VideoResult{Path: j.FileName + "." + j.Format, Size: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Error("temporary file left after saving")
+	}
+
+	h, err = openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finds := []struct {
+		job  kdramadl.Job
+		want bool
+	}{
+		{ep1, true},
+		{ep2, true},
+		{kdramadl.Job{Code: "abc", Resolution: kdramadl.ResolutionBest, Format: kdramadl.FormatMKV}, true},
+		{kdramadl.Job{Code: "abc", Resolution: kdramadl.ResolutionWorst, Format: kdramadl.FormatMKV}, true},
+		{kdramadl.Job{Code: "abc", Resolution: "1080p", Format: kdramadl.FormatMKV}, false},
+		{kdramadl.Job{Code: "abc", Resolution: "720p", Format: kdramadl.FormatMP4}, false},
+		{kdramadl.Job{Code: "ghi", Resolution: "720p", Format: kdramadl.FormatMKV}, false},
+	}
+	for _, test := range finds {
+		e, ok := h.find(test.job)
+		if ok != test.want {
+			t.Errorf("found %v: %v, want %v", test.job, ok, test.want)
+		} else if ok && (e.Code != test.job.Code || e.Path == "" || e.Time.IsZero()) {
+			t.Errorf("found %+v for %v", e, test.job)
+		}
+	}
+
+	if removed, err := h.forget("abc"); removed != 2 || err != nil {
+		t.Errorf("forgot %v downloads with error %v, want 2", removed, err)
+	}
+	if removed, err := h.forget("abc"); removed != 0 || err != nil {
+		t.Errorf("forgot %v downloads with error %v, want 0", removed, err)
+	}
+	h, err = openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.find(ep1); ok {
+		t.Error("forgotten download is still in the history")
+	}
+	if _, ok := h.find(ep2); !ok {
+		t.Error("download missing from the history after forgetting another")
+	}
+}
+
+func TestHistoryCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"code": "abc",`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openHistory(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("got error %v for a corrupt history, want one naming the file", err)
+	}
+	// the history is not overwritten
+	if data, _ := ioutil.ReadFile(path); string(data) != `[{"code": "abc",` {
+		t.Errorf("corrupt history changed to %q", data)
+	}
+}
+
+func TestDownloadSkipsHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	h, err := openHistory(filepath.Join(dir, "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded := kdramadl.Job{Code: "abc", FileName: "ep1", Resolution: "720p", Format: kdramadl.FormatMKV, Folder: dir}
+	if err := h.add(downloaded, &kdramadl.VideoResult{Path: "ep1.mkv"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		change  func(j *kdramadl.Job, opts *downloadOptions)
+		skipped bool
+	}{
+		{"downloaded", nil, true},
+		{"best resolution", func(j *kdramadl.Job, opts *downloadOptions) { j.Resolution = kdramadl.ResolutionBest }, true},
+		{"other resolution", func(j *kdramadl.Job, opts *downloadOptions) { j.Resolution = "1080p" }, false},
+		{"other format", func(j *kdramadl.Job, opts *downloadOptions) { j.Format = kdramadl.FormatMP4 }, false},
+		{"force", func(j *kdramadl.Job, opts *downloadOptions) { opts.force = true }, false},
+		{"clip", func(j *kdramadl.Job, opts *downloadOptions) { j.ClipEnd = time.Minute }, false},
+		{"subtitles only", func(j *kdramadl.Job, opts *downloadOptions) { opts.subOnly = true }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &kdramadl.Downloader{Hosts: []string{server.URL}}
+			j := downloaded
+			opts := downloadOptions{history: h}
+			if test.change != nil {
+				test.change(&j, &opts)
+			}
+			atomic.StoreInt32(&requests, 0)
+			err := download(context.Background(), d, j, metadata{}, opts)
+			if skipped := err == errSkipped; skipped != test.skipped {
+				t.Errorf("got error %v, want skipped %v", err, test.skipped)
+			}
+			if made := atomic.LoadInt32(&requests) > 0; made == test.skipped {
+				t.Errorf("made requests: %v, want %v", made, !test.skipped)
+			}
+		})
+	}
+}
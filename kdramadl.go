@@ -20,21 +20,23 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/lastmodified/kdramadl/kdramadl"
 	"github.com/urfave/cli/altsrc"
 	cli "gopkg.in/urfave/cli.v1"
 )
@@ -42,20 +44,11 @@ import (
 var build = "dev"
 
 const version = "0.1.8"
-const formatMKV = "mkv"
-const formatMP4 = "mp4"
-
-var formats = []string{formatMKV, formatMP4}
-var hostMain = "goplay.anontpp.com"
-var hostAlt = "kdrama.armsasuncion.com"
 
 var progHeader = fmt.Sprintf(`=====================================================
 KDRAMA DOWNLOADER (v:%v, b:%v)
 =====================================================
 `, version, build)
-var userAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:10.0) Gecko/20150101 Firefox/47.0 (Chrome)"
-var invalidDlCodeCharRegex = regexp.MustCompile(`[^a-zA-Z0-9]`)
-var validResRegex = regexp.MustCompile(`^([0-9]{3,4}p[+]?|[1-9])$`)
 var logger = &custLogger{level: levelInfo}
 
 func main() {
@@ -65,19 +58,53 @@ func main() {
 		res           string
 		format        string
 		fileName      string
+		outTemplate   string
+		series        string
+		season        string
+		episode       string
 		subOnly       bool
 		hardSubs      bool
+		clipStart     string
+		title         string
+		airDate       string
+		audioLang     string
+		subLang       string
+		audioTrack    string
+		subTrack      string
+		clipEnd       string
+		clipDuration  string
 		hardSubsStyle string
 		ffmpegPath    string
+		ffprobePath   string
 		dlFolder      string
 		altHost       bool
+		providerName  string
 		proxy         string
 		timeout       int
 		autoQuit      bool
+		jobs          int
+		resume        bool
+		native        bool
+		reencode      bool
+		profileName   string
+		retries       int
+		retryBackoff  int
+		retryMaxDelay int
+		retryJitter   int
+		connections   int
+		onConflict    string
+		subFormat     string
+		subOffset     string
+		subScale      string
 		verbose       bool
 		logFile       string
+		output        string
+		historyPath   string
+		force         bool
 	)
 	reader := bufio.NewReader(os.Stdin)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	cli.VersionPrinter = func(c *cli.Context) {
 		fmt.Fprintf(
@@ -98,15 +125,15 @@ func main() {
 		},
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:        "r, resolution",
-			Usage:       "Resolution of video, for example: 720p.",
+			Usage:       "Resolution of video, for example: 720p. Use \"best\" or \"worst\" to pick from the resolutions available.",
 			Destination: &res,
 		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name: "f, format",
 			Usage: fmt.Sprintf(
 				"Video format. Choose from: \"%v\". Default is %q.",
-				strings.Join(formats, "\" \""),
-				formats[0]),
+				strings.Join(kdramadl.Formats, "\" \""),
+				kdramadl.Formats[0]),
 			Destination: &format,
 		}),
 		cli.StringFlag{
@@ -114,6 +141,36 @@ func main() {
 			Usage:       "Filename to save as (without extension).",
 			Destination: &fileName,
 		},
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "output-template",
+			Usage:       "Build the filename from a template instead, e.g. \"{series}/Season {season}/{series} - E{episode:02} [{resolution}].{ext}\". Fields: {series} {season} {episode} {resolution} {ext} {code} {filename}.",
+			Destination: &outTemplate,
+		}),
+		cli.StringFlag{
+			Name:        "series",
+			Usage:       "Series name for the output template and the tags.",
+			Destination: &series,
+		},
+		cli.StringFlag{
+			Name:        "season",
+			Usage:       "Season number for the output template and the tags.",
+			Destination: &season,
+		},
+		cli.StringFlag{
+			Name:        "episode",
+			Usage:       "Episode number for the output template and the tags.",
+			Destination: &episode,
+		},
+		cli.StringFlag{
+			Name:        "title",
+			Usage:       "Title written into the video. Defaults to the filename.",
+			Destination: &title,
+		},
+		cli.StringFlag{
+			Name:        "date",
+			Usage:       "Air date written into the video, e.g. \"2017-05-21\".",
+			Destination: &airDate,
+		},
 		cli.BoolFlag{
 			Name:        "sub",
 			Usage:       "Download only subtitles.",
@@ -121,36 +178,108 @@ func main() {
 		},
 		altsrc.NewBoolFlag(cli.BoolFlag{
 			Name:        "hardsubs",
-			Usage:       "Enable hard subs (for mp4 only).",
+			Usage:       "Enable hard subs (not for mkv or the audio formats).",
 			Destination: &hardSubs,
 		}),
+		cli.StringFlag{
+			Name:        "start",
+			Usage:       "Cut a clip starting at this time, e.g. \"12:30\" or \"1:02:03.5\".",
+			Destination: &clipStart,
+		},
+		cli.StringFlag{
+			Name:        "end",
+			Usage:       "End the clip at this time.",
+			Destination: &clipEnd,
+		},
+		cli.StringFlag{
+			Name:        "duration",
+			Usage:       "Length of the clip instead of --end, e.g. \"45\" seconds or \"1:30\".",
+			Destination: &clipDuration,
+		},
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:        "hardsubsstyle",
 			Value:       "PrimaryColour=&H0000FFFF",
-			Usage:       "Custom hard subs font style, e.g. To make subs blue and font size 22 'FontSize=22,PrimaryColour=&H00FF0000'",
+			Usage:       "Custom hard subs (and ass subtitles) font style, e.g. To make subs blue and font size 22 'FontSize=22,PrimaryColour=&H00FF0000'",
 			Destination: &hardSubsStyle,
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "sub-format",
+			Value: kdramadl.SubtitleFormats[0],
+			Usage: fmt.Sprintf(
+				"Subtitle format. Choose from: \"%v\". \"ass\" subtitles are styled with --hardsubsstyle, also when muxed into mkv.",
+				strings.Join(kdramadl.SubtitleFormats, "\" \"")),
+			Destination: &subFormat,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "sub-offset",
+			Usage:       "Shift the subtitles later, or earlier if negative, e.g. \"1.5s\" or \"-2s\".",
+			Destination: &subOffset,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "sub-scale",
+			Usage:       "Multiply the subtitle times to match another framerate, e.g. \"25/23.976\" or \"1.001\".",
+			Destination: &subScale,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "audio-lang",
+			Value:       "kor",
+			Usage:       "Language of the audio track as a three letter code. Blank to leave it out.",
+			Destination: &audioLang,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "sub-lang",
+			Value:       "eng",
+			Usage:       "Language of the subtitle track as a three letter code. Blank to leave it out.",
+			Destination: &subLang,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "audio-title",
+			Usage:       "Title of the audio track. Defaults to the name of the language, e.g. \"Korean\".",
+			Destination: &audioTrack,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "sub-title",
+			Usage:       "Title of the subtitle track. Defaults to the name of the language, e.g. \"English\".",
+			Destination: &subTrack,
+		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:        "ffmpeg",
 			Value:       "ffmpeg",
 			Usage:       "Path to ffmpeg executable.",
 			Destination: &ffmpegPath,
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "ffprobe",
+			Usage:       "Path to ffprobe executable. Defaults to ffprobe next to ffmpeg, in PATH or in the current folder.",
+			Destination: &ffprobePath,
+		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:        "folder",
 			Value:       "",
 			Usage:       "Path to download folder.",
 			Destination: &dlFolder,
 		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name: "hosts",
+			Usage: fmt.Sprintf(
+				"Hosts to download from in order of preference, failing over to the next when one is down. Repeat for each host. Default is \"%v\".",
+				strings.Join(kdramadl.DefaultHosts, "\" \"")),
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "provider",
+			Value:       "goplay",
+			Usage:       "Name of the provider that builds the download URLs, \"goplay\" or one from the config file.",
+			Destination: &providerName,
+		}),
 		altsrc.NewBoolFlag(cli.BoolFlag{
 			Name:        "alt",
-			Usage:       fmt.Sprintf("Use %v instead of %v", hostAlt, hostMain),
+			Usage:       fmt.Sprintf("Start with the second host (%v by default) instead of the first", kdramadl.HostAlt),
 			Destination: &altHost,
 		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:        "proxy",
 			Value:       "",
-			Usage:       "Proxy address (only HTTP proxies supported), example \"http://127.0.0.1:80\".",
+			Usage:       "Proxy address (SOCKS proxies need --native), example \"http://127.0.0.1:80\" or \"socks5://127.0.0.1:1080\".",
 			Destination: &proxy,
 		}),
 		altsrc.NewIntFlag(cli.IntFlag{
@@ -159,6 +288,70 @@ func main() {
 			Usage:       "Connection timeout interval in seconds. Default 10.",
 			Destination: &timeout,
 		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        "resume",
+			Usage:       "Continue an interrupted download from its .part file instead of starting over (requires ffprobe).",
+			Destination: &resume,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "on-conflict",
+			Value: kdramadl.ConflictPolicies[0],
+			Usage: fmt.Sprintf(
+				"What to do when a .srt, .part or video file already exists. Choose from: \"%v\". \"rename\" saves as \"name (1).mkv\".",
+				strings.Join(kdramadl.ConflictPolicies, "\" \"")),
+			Destination: &onConflict,
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        "native",
+			Usage:       "Download the video directly and use ffmpeg only to mux it. Supports SOCKS proxies.",
+			Destination: &native,
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:        "reencode",
+			Usage:       "Always encode the video again. By default it is copied when the format can hold its codec (checked with ffprobe).",
+			Destination: &reencode,
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "profile",
+			Usage:       "Name of an encoding profile from the config file, for example to make smaller videos.",
+			Destination: &profileName,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        "retries",
+			Value:       3,
+			Usage:       "Number of times to retry a failed download. Default 3.",
+			Destination: &retries,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        "retry-backoff",
+			Value:       1,
+			Usage:       "Seconds to wait before the first retry, doubled for each retry after. Default 1.",
+			Destination: &retryBackoff,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        "retry-max-delay",
+			Value:       30,
+			Usage:       "Maximum seconds to wait between retries. Default 30.",
+			Destination: &retryMaxDelay,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        "retry-jitter",
+			Value:       20,
+			Usage:       "Percentage of the retry delay to randomly add or take away. Default 20.",
+			Destination: &retryJitter,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        "connections",
+			Value:       1,
+			Usage:       "Number of connections per download, implies --native. Default 1.",
+			Destination: &connections,
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        "jobs",
+			Value:       1,
+			Usage:       "Number of downloads to run in parallel in batch mode. Default 1.",
+			Destination: &jobs,
+		}),
 		altsrc.NewBoolFlag(cli.BoolFlag{
 			Name:        "autoquit",
 			Usage:       "Automatically quit when done (skip the \"Press ENTER to continue\" prompt)",
@@ -173,6 +366,22 @@ func main() {
 			Usage:       "Generate more verbose messages",
 			Destination: &verbose,
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "history",
+			Usage:       fmt.Sprintf("Path to the history of completed downloads. Default is %q.", defaultHistoryPath()),
+			Destination: &historyPath,
+		}),
+		cli.BoolFlag{
+			Name:        "force",
+			Usage:       "Download even if the history shows it was downloaded before.",
+			Destination: &force,
+		},
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "output",
+			Value:       outputText,
+			Usage:       "Output format: \"text\" or \"json\" (newline-delimited json events on stdout, implies --autoquit).",
+			Destination: &output,
+		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:        "logfile",
 			Value:       "",
@@ -192,9 +401,21 @@ func main() {
 				// file exists
 				err := altsrc.InitInputSourceWithContext(
 					app.Flags, altsrc.NewYamlSourceFromFlagFunc("config"))(c)
-				return err
+				if err != nil {
+					return err
+				}
 			}
 		}
+		// set before any command runs so that early errors are reported
+		// in the right mode
+		if err := setOutputMode(output); err != nil {
+			return err
+		}
+		if outputMode == outputJSON {
+			// there is nobody to press ENTER, and stdout is for the events
+			autoQuit = true
+			c.App.Writer = os.Stderr
+		}
 		return nil
 	}
 	app.OnUsageError = func(c *cli.Context, err error, isSubcommand bool) error {
@@ -206,18 +427,103 @@ func main() {
 		fmt.Fprintf(c.App.Writer, "\nUsage error: %v\n", err)
 		return nil
 	}
-	app.Action = func(c *cli.Context) error {
+	// loadHistory opens the history of completed downloads
+	loadHistory := func() (*downloadHistory, error) {
+		if historyPath == "" {
+			historyPath = defaultHistoryPath()
+		}
+		h, err := openHistory(historyPath)
+		if err != nil {
+			return nil, withCode(codeInvalidOption, err)
+		}
+		return h, nil
+	}
+	// loadOptions returns the options shared by every download
+	loadOptions := func() (downloadOptions, error) {
+		opts := downloadOptions{subOnly: subOnly, force: force}
+		var err error
+		if opts.history, err = loadHistory(); err != nil {
+			return opts, err
+		}
+		if outTemplate != "" {
+			if opts.template, err = parseTemplate(outTemplate); err != nil {
+				return opts, withCode(codeInvalidOption, err)
+			}
+		}
+		opts.meta.Series = strings.TrimSpace(series)
+		opts.meta.Title = strings.TrimSpace(title)
+		opts.meta.Date = strings.TrimSpace(airDate)
+		opts.meta.AudioLanguage = strings.TrimSpace(audioLang)
+		opts.meta.SubtitleLanguage = strings.TrimSpace(subLang)
+		opts.meta.AudioTitle = strings.TrimSpace(audioTrack)
+		opts.meta.SubtitleTitle = strings.TrimSpace(subTrack)
+		if opts.meta.Season, err = parseNumber("season", season); err != nil {
+			return opts, withCode(codeInvalidOption, err)
+		}
+		if opts.meta.Episode, err = parseNumber("episode", episode); err != nil {
+			return opts, withCode(codeInvalidOption, err)
+		}
+		if opts.clipStart, opts.clipEnd, err = parseClip(clipStart, clipEnd, clipDuration); err != nil {
+			return opts, withCode(codeInvalidOption, err)
+		}
+		return opts, nil
+	}
+	// setup applies the global options and returns a downloader ready for use.
+	// Only downloads need ffmpeg, probing the host is done without it.
+	setup := func(c *cli.Context, needsFFmpeg bool) (*kdramadl.Downloader, error) {
 
 		if logFile != "" {
 			logger.logFile = logFile
 		}
-		if c.Bool("nocolor") {
+		if c.GlobalBool("nocolor") {
 			color.NoColor = true
 		}
 		if verbose {
 			logger.level = levelDebug
 		}
-		fmt.Printf(progHeader)
+		fmt.Fprint(logOutput, progHeader)
+
+		if retries < 0 || retryBackoff < 0 || retryMaxDelay < 0 || retryJitter < 0 || retryJitter > 100 {
+			return nil, withCode(codeInvalidOption, errors.New("Invalid retry options"))
+		}
+		if !stringInSlice(subFormat, kdramadl.SubtitleFormats) {
+			return nil, withCode(codeInvalidOption, fmt.Errorf("Invalid subtitle format: %v", subFormat))
+		}
+		subtitleOffset, err := parseOffset(subOffset)
+		if err != nil {
+			return nil, withCode(codeInvalidOption, err)
+		}
+		subtitleScale, err := parseScale(subScale)
+		if err != nil {
+			return nil, withCode(codeInvalidOption, err)
+		}
+		if !stringInSlice(onConflict, kdramadl.ConflictPolicies) {
+			return nil, withCode(codeInvalidOption, fmt.Errorf("Invalid conflict policy: %v", onConflict))
+		}
+		if connections < 1 {
+			return nil, withCode(codeInvalidOption, fmt.Errorf("Invalid number of connections: %v", connections))
+		} else if connections > 1 {
+			// only the native downloader can split a download
+			native = true
+		}
+
+		config, err := readConfig(c.GlobalString("config"))
+		if err != nil {
+			return nil, withCode(codeInvalidOption, err)
+		}
+		provider, err := config.provider(providerName)
+		if err != nil {
+			return nil, withCode(codeInvalidOption, err)
+		}
+
+		profile, err := config.profile(profileName)
+		if err != nil {
+			return nil, withCode(codeInvalidOption, err)
+		}
+		if profile != nil && profile.TargetSize != "" {
+			// the duration of the downloaded file is needed for the bitrate
+			native = true
+		}
 
 		ex, _ := os.Executable()
 		cwd := filepath.Dir(ex)
@@ -226,18 +532,32 @@ func main() {
 			ffmpegPath, path.Join(cwd, "ffmpeg"), path.Join(cwd, "ffmpeg.exe")}
 
 		// Try to find the correct ffmpeg path
-		var verifiedFfmpegPath string
-		for _, testPath := range ffmpegPaths {
-			ffmpegCmd := exec.Command(testPath, "-version")
-			err := ffmpegCmd.Run()
-			if err == nil {
-				verifiedFfmpegPath = testPath
-				break
+		verifiedFfmpegPath := findExecutable(ffmpegPaths)
+		if verifiedFfmpegPath == "" && needsFFmpeg {
+			// no ffmpeg found
+			return nil, withCode(codeFFmpegNotFound, errors.New("Unable to find valid ffmpeg path"))
+		}
+
+		// ffprobe is optional, but without it every video is encoded again
+		ffprobePaths := []string{ffprobePath}
+		if ffprobePath == "" {
+			dir, base := filepath.Split(verifiedFfmpegPath)
+			if verifiedFfmpegPath == "" {
+				dir, base = filepath.Split(ffmpegPath)
 			}
+			ffprobePaths = []string{
+				dir + strings.Replace(base, "ffmpeg", "ffprobe", 1), "ffprobe",
+				path.Join(cwd, "ffprobe"), path.Join(cwd, "ffprobe.exe")}
 		}
-		if verifiedFfmpegPath == "" {
-			// no ffmpeg found
-			return errors.New("Unable to find valid ffmpeg path")
+		verifiedFfprobePath := findExecutable(ffprobePaths)
+		if verifiedFfprobePath == "" && needsFFmpeg {
+			logger.Warning("Unable to find ffprobe, so videos are always encoded again, " +
+				"--resume starts over and the progress has no percentage. Use --ffprobe to set its path.")
+		} else if verifiedFfprobePath == "" {
+			logger.Warning("Unable to find ffprobe, so the durations are unknown. Use --ffprobe to set its path.")
+		}
+		if verifiedFfprobePath == "" {
+			verifiedFfprobePath = ffprobePaths[0]
 		}
 
 		var httpClient *http.Client
@@ -246,11 +566,11 @@ func main() {
 		} else {
 			proxyURL, err := url.Parse(proxy)
 			if err != nil {
-				return err
+				return nil, withCode(codeInvalidOption, err)
 			}
-			if !strings.HasPrefix(proxyURL.Scheme, "http") {
+			if needsFFmpeg && !native && !strings.HasPrefix(proxyURL.Scheme, "http") {
 				// Because ffmpeg does not support SOCKS proxies
-				return fmt.Errorf("Unsupport proxy scheme: %v", proxyURL.Scheme)
+				return nil, withCode(codeInvalidOption, fmt.Errorf("Unsupport proxy scheme: %v", proxyURL.Scheme))
 			}
 			logger.Debugf("Using proxy: %v", proxy)
 			httpClient = &http.Client{
@@ -258,183 +578,349 @@ func main() {
 			}
 		}
 
-		// Prompt for user inputs
-		if dlCode == "" {
+		hosts := c.GlobalStringSlice("hosts")
+		if len(hosts) == 0 {
+			hosts = kdramadl.DefaultHosts
+		}
+		if altHost == true && len(hosts) > 1 {
+			hosts = append(append([]string{}, hosts[1:]...), hosts[0])
+		}
+		logger.Debugf("App Version: %v, Provider: %v, Hosts: %v", version, providerName, hosts)
+
+		return &kdramadl.Downloader{
+			Hosts:          hosts,
+			Provider:       provider,
+			Client:         httpClient,
+			FFmpegPath:     verifiedFfmpegPath,
+			FFprobePath:    verifiedFfprobePath,
+			Folder:         cwd, // default to the executable's folder
+			Proxy:          proxy,
+			Timeout:        time.Duration(timeout) * time.Second,
+			HardSubsStyle:  hardSubsStyle,
+			SubtitleFormat: subFormat,
+			SubtitleOffset: subtitleOffset,
+			SubtitleScale:  subtitleScale,
+			Verbose:        verbose,
+			Resume:         resume,
+			Native:         native,
+			Reencode:       reencode,
+			Profile:        profile,
+			Retries:        retries,
+			RetryBackoff:   time.Duration(retryBackoff) * time.Second,
+			RetryMaxDelay:  time.Duration(retryMaxDelay) * time.Second,
+			RetryJitter:    float64(retryJitter) / 100,
+			Connections:    connections,
+			OnConflict:     onConflict,
+			OnProgress:     showProgress(false),
+			OnRetry:        emitRetrying,
+			Logger:         logger,
+		}, nil
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "subs",
+			Usage: "Edit downloaded subtitles",
+			Subcommands: []cli.Command{
+				{
+					Name:      "shift",
+					Usage:     "Shift or scale the times of .srt files, which are changed in place",
+					ArgsUsage: "FILE...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "offset",
+							Usage: "Shift the subtitles later, or earlier if negative, e.g. \"1.5s\" or \"-2s\".",
+						},
+						cli.StringFlag{
+							Name:  "scale",
+							Usage: "Multiply the subtitle times to match another framerate, e.g. \"25/23.976\".",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							return withCode(codeInvalidOption, errors.New("Subtitle file is required"))
+						}
+						offset, err := parseOffset(c.String("offset"))
+						if err != nil {
+							return withCode(codeInvalidOption, err)
+						}
+						scale, err := parseScale(c.String("scale"))
+						if err != nil {
+							return withCode(codeInvalidOption, err)
+						}
+						if offset == 0 && scale == 1 {
+							return withCode(codeInvalidOption, errors.New("Use --offset or --scale to change the times"))
+						}
+						for _, path := range c.Args() {
+							if err := shiftSubtitles(path, offset, scale); err != nil {
+								return err
+							}
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "history",
+			Usage: "List or forget completed downloads",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List the completed downloads",
+					Action: func(c *cli.Context) error {
+						h, err := loadHistory()
+						if err != nil {
+							return err
+						}
+						showHistory(h)
+						return nil
+					},
+				},
+				{
+					Name:      "forget",
+					Usage:     "Remove the downloads of one or more codes from the history so that they are downloaded again",
+					ArgsUsage: "CODE...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							return withCode(codeInvalidOption, errors.New("Download Code is required"))
+						}
+						h, err := loadHistory()
+						if err != nil {
+							return err
+						}
+						for _, code := range c.Args() {
+							removed, err := h.forget(code)
+							if err != nil {
+								return err
+							}
+							logger.Infof("Removed %v downloads of %v from the history", removed, code)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:        "probe",
+			Aliases:     []string{"info"},
+			Usage:       "List the resolutions available for a download code",
+			ArgsUsage:   "[CODE]",
+			Description: "Each resolution offered by the provider is checked against the host. CODE defaults to --code.",
+			Action: func(c *cli.Context) error {
+				code := c.Args().First()
+				if code == "" {
+					code = dlCode
+				}
+				if code == "" {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					return withCode(codeInvalidOption, errors.New("Download Code is required"))
+				}
+				d, err := setup(c, false)
+				if err != nil {
+					return err
+				}
+				cancelOnSignal(cancel)
+				qualities, err := d.ListQualities(ctx, kdramadl.Job{Code: code})
+				if err != nil {
+					if ctx.Err() != nil {
+						return errCancelled
+					}
+					return err
+				}
+				showQualities(code, qualities)
+				if !anyAvailable(qualities) {
+					return fmt.Errorf("%w for %v", kdramadl.ErrResolutionUnavailable, code)
+				}
+				if !autoQuit {
+					input("\bPress ENTER to continue...", reader)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "batch",
+			Usage:     "Download every entry in a queue file (.yml, .csv or .jsonl)",
+			ArgsUsage: "QUEUE_FILE",
+			Description: "Each entry may specify code, filename, resolution, format, folder, hardsubs, series, season, episode,\n" +
+				"   title, date, audio_lang and sub_lang.\n" +
+				"   Missing values default to the global options. A failed entry does not stop the queue.",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					return withCode(codeInvalidOption, errors.New("Queue file is required"))
+				}
+				d, err := setup(c, true)
+				if err != nil {
+					return err
+				}
+				entries, err := readQueue(c.Args().First())
+				if err != nil {
+					return withCode(codeInvalidQueue, err)
+				}
+				logger.Infof("Loaded %v entries from %v", len(entries), c.Args().First())
+
+				defaults := kdramadl.Job{
+					Resolution: res,
+					Format:     format,
+					Folder:     dlFolder,
+					HardSubs:   hardSubs,
+				}
+				if jobs < 1 {
+					return withCode(codeInvalidOption, fmt.Errorf("Invalid number of jobs: %v", jobs))
+				}
+				d.Parallel = jobs > 1
+				d.OnProgress = showProgress(d.Parallel)
+				opts, err := loadOptions()
+				if err != nil {
+					return err
+				}
+				defaults.ClipStart, defaults.ClipEnd = opts.clipStart, opts.clipEnd
+				cancelOnSignal(cancel)
+
+				queue := make([]kdramadl.Job, len(entries))
+				metas := make([]metadata, len(entries))
+				queueErrs := make([]error, len(entries))
+				for i, entry := range entries {
+					queue[i] = entry.toJob(defaults)
+					metas[i] = entry.metadata(opts.meta)
+					queueErrs[i] = opts.nameJob(&queue[i], metas[i])
+				}
+				for i, err := range checkOutputPaths(queue, d.SubtitleFormat, opts.subOnly) {
+					if err != nil && queueErrs[i] == nil {
+						queueErrs[i] = withCode(codeInvalidJob, err)
+					}
+				}
+
+				results := make([]error, len(entries))
+				pending := make(chan int)
+				var wg sync.WaitGroup
+				for w := 0; w < jobs; w++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := range pending {
+							log := logger.withPrefix(fmt.Sprintf("[%v/%v %v]", i+1, len(queue), queue[i].FileName))
+							queue[i].Logger = log
+							if ctx.Err() != nil {
+								results[i] = errCancelled
+								emitError(&queue[i], results[i])
+								continue
+							}
+							log.Infof("Processing %v", queue[i])
+							if queueErrs[i] != nil {
+								results[i] = queueErrs[i]
+							} else if err := d.Validate(&queue[i]); err != nil {
+								results[i] = withCode(codeInvalidJob, err)
+							} else {
+								results[i] = download(ctx, d, queue[i], metas[i], opts)
+							}
+							if results[i] != nil && results[i] != errSkipped {
+								log.Errorf("%v", results[i])
+								emitError(&queue[i], results[i])
+							}
+						}
+					}()
+				}
+				for i := range queue {
+					pending <- i
+				}
+				close(pending)
+				wg.Wait()
+
+				// Summary
+				failed := 0
+				logger.Info("Batch summary:")
+				skipped := 0
+				for i, j := range queue {
+					if results[i] == errSkipped {
+						skipped++
+						logger.Infof("  SKIPPED %v", j)
+					} else if results[i] != nil {
+						failed++
+						logger.Errorf("  FAILED  %v: %v", j, results[i])
+					} else {
+						logger.Infof("  OK      %v", j)
+					}
+				}
+				logger.Infof("%v succeeded, %v skipped, %v failed", len(entries)-failed-skipped, skipped, failed)
+				if ctx.Err() != nil {
+					return errCancelled
+				}
+				if failed > 0 {
+					return withCode(codeBatchFailed, fmt.Errorf("%v of %v downloads failed", failed, len(entries)))
+				}
+				if !autoQuit {
+					input("\bPress ENTER to continue...", reader)
+				}
+				return nil
+			},
+		},
+	}
+
+	app.Action = func(c *cli.Context) error {
+
+		d, err := setup(c, true)
+		if err != nil {
+			return err
+		}
+		opts, err := loadOptions()
+		if err != nil {
+			return err
+		}
+
+		// Prompt for user inputs, which would mix with the json events
+		interactive := outputMode == outputText
+		if dlCode == "" && interactive {
 			dlCode = input("Enter the Download Code: ", reader)
 		}
 		if dlCode == "" {
-			return errors.New("Download Code cannot be blank")
-		} else if invalidDlCodeCharRegex.MatchString(dlCode) {
-			return errors.New("Invalid Download Code")
+			return withCode(codeInvalidOption, errors.New("Download Code cannot be blank"))
 		}
 
-		if fileName == "" {
+		if fileName == "" && opts.template == nil && interactive {
 			fileName = input("Enter the Filename (no extension): ", reader)
 		}
-		if fileName == "" {
-			return errors.New("Filename cannot be blank")
+		if fileName == "" && opts.template == nil {
+			return withCode(codeInvalidOption, errors.New("Filename cannot be blank"))
 		}
 
-		if res == "" {
-			res = input("Enter a Resolution (please check on video page): ", reader)
+		if res == "" && interactive {
+			res = input("Enter a Resolution, e.g. 720p, best or worst (run \"kdramadl probe\" to list them): ", reader)
 		}
 		if res == "" {
-			return errors.New("Resolution cannot be blank")
-		} else if validResRegex.MatchString(res) != true {
-			return fmt.Errorf("Invalid resolution: %v", res)
+			return withCode(codeInvalidOption, errors.New("Resolution cannot be blank"))
 		}
 
-		if format == "" {
+		if format == "" && interactive {
 			format = input(fmt.Sprintf(
 				"Choose a Format (%v). Press ENTER to use the default (%v): ",
-				strings.Join(formats, ", "), formats[0]), reader)
-		}
-		if format == "" {
-			format = formats[0]
-		} else if stringInSlice(format, formats) != true {
-			return fmt.Errorf("Invalid format: %v", format)
-		}
-
-		hostname := fmt.Sprintf("https://%v/", hostMain)
-		if altHost == true {
-			hostname = fmt.Sprintf("https://%v/", hostAlt)
-		}
-		subURL := fmt.Sprintf(
-			"%v?dcode=%v&downloadccsub=1", hostname, url.QueryEscape(dlCode))
-		vidURL := fmt.Sprintf(
-			"%v?dcode=%v&quality=%v&downloadmp4vid=1", hostname,
-			url.QueryEscape(dlCode), url.QueryEscape(res))
-
-		var absFolderPath string
-		if dlFolder != "" {
-			absFolderPath, _ = filepath.Abs(dlFolder)
-			if stat, err := os.Stat(absFolderPath); err != nil || !stat.IsDir() {
-				os.MkdirAll(dlFolder, os.ModePerm)
-				logger.Infof("Created folder: %v", absFolderPath)
-			}
+				strings.Join(kdramadl.Formats, ", "), kdramadl.Formats[0]), reader)
 		}
-		if absFolderPath == "" {
-			// default to current working folder
-			absFolderPath = cwd
-		}
-		logger.Debugf(
-			"App Version: %v, Download Code: %v, Resolution: %v, Filename: %v, Format: %v, Folder: %v, Proxy: %v, Hard Subs: %v, Hard Subs Style: %v",
-			version, dlCode, res, fileName, format, absFolderPath, proxy,
-			hardSubs, hardSubsStyle)
-
-		subFilePath := path.Join(absFolderPath, fmt.Sprintf("%v.srt", fileName))
-		vidFilePath := path.Join(absFolderPath, fmt.Sprintf("%v.%v", fileName, format))
-		// part file is the intermediary temp file generated by ffmpeg which will
-		// be renamed to the actual vid file name (vidFilePath)
-		partFilePath := path.Join(absFolderPath, fmt.Sprintf("%v.%v.part", fileName, format))
-
-		// Download subtitles
-		if subOnly == true || format == formatMP4 {
 
-			request, _ := http.NewRequest("GET", subURL, nil)
-			request.Header.Set("User-Agent", userAgent)
-			logger.Debugf("Requesting %v", subURL)
-			response, err := httpClient.Do(request)
-			if err != nil {
-				return fmt.Errorf("Error downloading subtitles: %v", err)
-			}
-			if response.StatusCode >= 400 {
-				return fmt.Errorf("Error downloading subtitles: HTTP %v", response.StatusCode)
-			}
-			contentType := response.Header.Get("content-type")
-			if strings.Contains(contentType, "text/html") {
-				return fmt.Errorf(
-					"Error downloading subtitles: Unexpected Content-Type \"%v\"",
-					contentType)
-			}
-			defer response.Body.Close()
-			output, err := os.Create(subFilePath)
-			if err != nil {
-				return fmt.Errorf("%v already exists", subFilePath)
-			}
-			defer output.Close()
-			if _, err := io.Copy(output, response.Body); err != nil {
-				return fmt.Errorf("Error downloading subtitles: %v", err)
-			}
-			logger.Infof("Saved subtitles: %v", subFilePath)
+		j := kdramadl.Job{
+			Code:       dlCode,
+			FileName:   fileName,
+			Resolution: res,
+			Format:     format,
+			Folder:     dlFolder,
+			HardSubs:   hardSubs,
+			ClipStart:  opts.clipStart,
+			ClipEnd:    opts.clipEnd,
 		}
-		if subOnly == true {
-			return nil
+		meta := opts.meta
+		meta.FileName = fileName
+		if err := opts.nameJob(&j, meta); err != nil {
+			return err
 		}
-
-		ffmpegLogLevel := "fatal"
-		if verbose {
-			ffmpegLogLevel = "warning"
-		}
-		ffmpegCmd := genFfmpegCmd(
-			verifiedFfmpegPath, ffmpegLogLevel, timeout,
-			vidURL, subURL, format, partFilePath, proxy,
-			subFilePath, hardSubs, hardSubsStyle, false)
-		logger.Debugf("Requesting %v", vidURL)
-		logger.Debugf("FFMPEG args: %v", ffmpegCmd.Args)
-
-		if err := ffmpegCmd.Run(); err != nil {
-			logger.Warningf("Retrying ffmpeg command due to: %v", err.Error())
-			// Retry with a more verbose loglevel
-			if ffmpegLogLevel == "fatal" {
-				ffmpegLogLevel = "warning"
-			}
-			ffmpegCmd := genFfmpegCmd(
-				verifiedFfmpegPath, ffmpegLogLevel, timeout,
-				vidURL, subURL, format, partFilePath, proxy,
-				subFilePath, hardSubs, hardSubsStyle, true)
-			logger.Debugf("Requesting %v", vidURL)
-			logger.Debugf("FFMPEG args: %v", ffmpegCmd.Args)
-
-			// capture error pipe so that we can log it
-			e, _ := ffmpegCmd.StderrPipe()
-			if err := ffmpegCmd.Start(); err != nil {
-				logger.Errorf("Error starting command: %v", err.Error())
-				return err
-			}
-			defer e.Close()
-			if ffmpegOutput, err := ioutil.ReadAll(e); err == nil {
-				logger.Errorf("FFMPEG Error: %s", ffmpegOutput)
-			}
-
-			if err := ffmpegCmd.Wait(); err != nil {
-				// Do http request to check what's wrong
-				request, _ := http.NewRequest("GET", vidURL, nil)
-				request.Header.Set("User-Agent", userAgent)
-				response, err := httpClient.Do(request)
-
-				if err != nil {
-					return fmt.Errorf("Error downloading video: %v", err)
-				}
-				if response.StatusCode >= 400 {
-					return fmt.Errorf(
-						"Error downloading video: HTTP %v %q",
-						response.StatusCode, response.Request.URL.String())
-				}
-				contentType := response.Header.Get("content-type")
-				if strings.Contains(contentType, "text/html") {
-					return fmt.Errorf(
-						"Error downloading video: Unexpected Content-Type %q",
-						contentType)
-				}
-				return fmt.Errorf("ffmpeg Error: %v", err)
-			}
+		if err := d.Validate(&j); err != nil {
+			return withCode(codeInvalidJob, err)
 		}
-		if _, err := os.Stat(partFilePath); !os.IsNotExist(err) {
-			// rename .part file to final filename
-			err := os.Rename(partFilePath, vidFilePath)
-			if err != nil {
-				logger.Debugf("Error renaming %q to %q: %v", partFilePath, vidFilePath, err)
-				return errors.New("Unable to rename file")
-			}
-		}
-		if _, err := os.Stat(vidFilePath); !os.IsNotExist(err) {
-			if format == formatMP4 && hardSubs {
-				// clear srt file since it's already hard subbed
-				logger.Debugf("Deleting %v\n", subFilePath)
-				os.Remove(subFilePath)
-			}
-			logger.Infof("Saved video: %v", vidFilePath)
+		cancelOnSignal(cancel)
+		if err := download(ctx, d, j, meta, opts); err != nil && err != errSkipped {
+			return err
 		}
 		if !autoQuit {
 			input("\bPress ENTER to continue...", reader)
@@ -445,59 +931,140 @@ func main() {
 	err := app.Run(os.Args)
 	if err != nil {
 		logger.Errorf("%v", err)
-		if !autoQuit {
+		emitError(nil, err)
+		if !autoQuit && ctx.Err() == nil {
 			input("\bPress ENTER to continue...", reader)
 		}
+		os.Exit(exitCode(err))
+	}
+}
+
+var errCancelled = errors.New("Download cancelled")
+
+// errSkipped is returned by download for a video in the history, or
+// when a file exists and --on-conflict is skip
+var errSkipped = errors.New("Already downloaded")
+
+// downloadOptions are the options that apply to every download
+type downloadOptions struct {
+	subOnly  bool
+	force    bool // download videos that are in the history again
+	history  *downloadHistory
+	template *outputTemplate // builds the filenames if set
+	meta     metadata        // defaults for the metadata of each job
+	// clipStart and clipEnd cut the same clip out of every job
+	clipStart time.Duration
+	clipEnd   time.Duration
+}
+
+// nameJob sets the filename of a job from the output template, if there
+// is one, and the tags written into its container
+func (opts downloadOptions) nameJob(j *kdramadl.Job, m metadata) error {
+	if opts.template != nil {
+		fileName, err := opts.template.render(*j, m)
+		if err != nil {
+			return withCode(codeInvalidJob, err)
+		}
+		j.FileName = fileName
 	}
+	j.Tags = m.tags(*j)
+	return nil
 }
 
-// genFfmpegCmd creates a Command for ffmpeg with the specified params
-func genFfmpegCmd(
-	ffmpegPath string, ffmpegLogLevel string, timeout int,
-	vidURL string, subURL string,
-	format string, partFilePath string, proxy string,
-	subFilePath string, hardSubs bool, hardSubsStyle string, captureStdErr bool) *exec.Cmd {
-
-	args := []string{"-loglevel", ffmpegLogLevel, "-stats", "-y",
-		"-timeout", fmt.Sprintf("%v", timeout*1000000), // in microseconds
-		"-reconnect", "1", "-reconnect_streamed", "1"}
-	if proxy != "" {
-		args = append(args, []string{"-http_proxy", proxy}...)
+// download fetches the subtitles and video for a job
+func download(ctx context.Context, d *kdramadl.Downloader, j kdramadl.Job, m metadata, opts downloadOptions) error {
+	subOnly := opts.subOnly
+	// clips are not kept in the history, which is for whole videos
+	if !subOnly && !opts.force && !j.IsClip() {
+		if e, ok := opts.history.find(j); ok {
+			jobLogger(j).Infof("Skipping %v, downloaded on %v to %v (use --force to download again)",
+				j, e.Time.Local().Format("2006-01-02 15:04"), e.Path)
+			emitSkipped(j, e)
+			return errSkipped
+		}
 	}
-	args = append(args, []string{"-i", vidURL}...)
-	if format == formatMKV || !hardSubs {
-		args = append(args, []string{"-i", subURL}...)
-	} else {
-		if _, err := os.Stat(subFilePath); !os.IsNotExist(err) {
-			vf := fmt.Sprintf("subtitles=%v", subFilePath)
-			if hardSubsStyle != "" {
-				vf = fmt.Sprintf("subtitles=%v:force_style='%v'", subFilePath, hardSubsStyle)
+	if !subOnly {
+		if err := d.PickResolution(ctx, &j); err != nil {
+			if ctx.Err() != nil {
+				return errCancelled
 			}
-			args = append(args, []string{"-vf", vf}...)
+			return err
+		}
+		// {resolution} may have been best or worst
+		if err := opts.nameJob(&j, m); err != nil {
+			return err
+		}
+	}
+	// one name for the video and its subtitles, before anything is written
+	resolved, existing, err := d.ResolveConflicts(j, subOnly)
+	if err != nil {
+		return err
+	} else if existing != "" {
+		emitExists(j, existing)
+		return errSkipped
+	}
+	j = resolved
+	emitStarted(j)
+	if subOnly == true || kdramadl.KeepsSubtitles(j.Format) {
+		result, err := d.DownloadSubtitles(ctx, j)
+		if err != nil {
+			if ctx.Err() != nil {
+				return errCancelled
+			}
+			return err
 		}
+		emitSubtitleSaved(j, result)
 	}
-	if format == formatMP4 {
-		if !hardSubs {
-			args = append(args, []string{"-c:s", "mov_text"}...)
+	if subOnly == true {
+		return nil
+	}
+	result, err := d.DownloadVideo(ctx, j)
+	if err != nil {
+		if ctx.Err() != nil {
+			return errCancelled
 		}
-		args = append(args, []string{"-c:v", "libx264", "-c:a", "copy"}...)
+		return err
+	}
+	emitVideoSaved(j, result)
+	if j.IsClip() {
+		return nil
+	}
+	if err := opts.history.add(j, result); err != nil {
+		jobLogger(j).Warningf("Unable to save the history: %v", err)
 	}
-	ffmpegOutputFormat := "mp4"
-	if format == formatMKV {
-		args = append(
-			args, []string{"-c", "copy"}...)
-		ffmpegOutputFormat = "matroska"
+	return nil
+}
+
+// jobLogger returns the logger for a job
+func jobLogger(j kdramadl.Job) kdramadl.Logger {
+	if j.Logger != nil {
+		return j.Logger
 	}
-	args = append(
-		args, []string{"-bsf:a", "aac_adtstoasc", "-f", ffmpegOutputFormat, partFilePath}...)
-	ffmpegCmd := exec.Command(ffmpegPath, args...)
+	return logger
+}
+
+// cancelOnSignal calls cancel on the first SIGINT or SIGTERM so that running
+// downloads can stop cleanly. A second signal exits immediately.
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Warning("Cancelling... press Ctrl+C again to exit immediately")
+		cancel()
+		<-signals
+		os.Exit(1)
+	}()
+}
 
-	if !captureStdErr {
-		ffmpegCmd.Stderr = os.Stderr
+// findExecutable returns the first of paths that runs, or "" if none do
+func findExecutable(paths []string) string {
+	for _, testPath := range paths {
+		if err := exec.Command(testPath, "-version").Run(); err == nil {
+			return testPath
+		}
 	}
-	ffmpegCmd.Stdout = os.Stdout
-	ffmpegCmd.Stdin = os.Stdin
-	return ffmpegCmd
+	return ""
 }
 
 // input is a console prompt for user input
@@ -508,7 +1075,6 @@ func input(promptText string, reader *bufio.Reader) string {
 	return response
 }
 
-// stringInSlice returns a bool indicating if specified string is in the list of strings
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -532,6 +1098,16 @@ const (
 type custLogger struct {
 	level   int
 	logFile string
+	prefix  string
+}
+
+// logMutex serialises output from loggers used by concurrent downloads
+var logMutex sync.Mutex
+
+// withPrefix returns a copy of the logger that prefixes every message
+func (logger custLogger) withPrefix(prefix string) custLogger {
+	logger.prefix = prefix
+	return logger
 }
 
 // color functions for formatting console output
@@ -565,13 +1141,25 @@ func (logger custLogger) Log(level int, message string) {
 		levelName = "DEBUG"
 		colorFn = blue
 	}
+	if logger.prefix != "" {
+		message = fmt.Sprintf("%v %v", logger.prefix, message)
+	}
 	formattedMessage = fmt.Sprintf("%v: %v", colorFn(levelName), message)
 
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
 	if level >= logger.level {
+		if barVisible {
+			// leave the progress bar on its own line
+			fmt.Fprintln(logOutput)
+			barVisible = false
+			lastBarWidth = 0
+		}
 		if strings.HasSuffix(formattedMessage, "\n") {
-			fmt.Print(formattedMessage)
+			fmt.Fprint(logOutput, formattedMessage)
 		} else {
-			fmt.Println(formattedMessage)
+			fmt.Fprintln(logOutput, formattedMessage)
 		}
 	}
 
@@ -579,7 +1167,7 @@ func (logger custLogger) Log(level int, message string) {
 	if logger.logFile != "" {
 		file, err := os.OpenFile(logger.logFile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
 		if err != nil {
-			fmt.Println(fmt.Sprintf("%v: %v", red("ERROR"), err.Error()))
+			fmt.Fprintln(logOutput, fmt.Sprintf("%v: %v", red("ERROR"), err.Error()))
 			return
 		}
 		defer file.Close()
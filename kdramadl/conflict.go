@@ -0,0 +1,120 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Policies for output files that already exist
+const (
+	ConflictOverwrite = "overwrite" // Replace the file
+	ConflictSkip      = "skip"      // Keep the file and skip the download
+	ConflictRename    = "rename"    // Save as "FileName (1)" instead
+	ConflictFail      = "fail"      // Return ErrFileExists
+)
+
+// ConflictPolicies lists the policies for Downloader.OnConflict.
+// The first one is the default.
+var ConflictPolicies = []string{ConflictOverwrite, ConflictSkip, ConflictRename, ConflictFail}
+
+// ResolveConflicts applies OnConflict to the files that a job will write:
+// the video, its subtitles and the unfinished .part file, or only the
+// subtitles if subOnly. It is decided once for all of them and before any
+// is written. With Resume the .part file is continued instead. With
+// ConflictRename the returned job has the first "FileName (n)" for which
+// none of the files exist, so that the video and its subtitles keep
+// matching names. With ConflictSkip the path of an existing file is
+// returned.
+//
+// DownloadSubtitles and DownloadVideo resolve the conflicts of jobs that
+// have not been resolved yet. Callers that download both for a job must
+// call ResolveConflicts first and pass the returned job to both calls, so
+// that they share the name and the video is muxed with the subtitles that
+// were just saved.
+func (d *Downloader) ResolveConflicts(job Job, subOnly bool) (Job, string, error) {
+	log := d.logger(job)
+	folder, err := d.folder(job)
+	if err != nil {
+		return job, "", err
+	}
+	exts := []string{"." + d.subtitleFormat()}
+	if !subOnly {
+		exts = []string{"." + job.Format, "." + d.subtitleFormat()}
+		if !d.Resume {
+			exts = append(exts, fmt.Sprintf(".%v.part", job.Format))
+		}
+	}
+	existing := existingFile(folder, job.FileName, exts)
+	if existing == "" {
+		job.state = &jobState{}
+		return job, "", nil
+	}
+	switch d.OnConflict {
+	case ConflictSkip:
+		log.Infof("Skipping, %v already exists", existing)
+		return job, existing, nil
+	case ConflictFail:
+		return job, "", fmt.Errorf("%w: %v", ErrFileExists, existing)
+	case ConflictRename:
+		for n := 1; ; n++ {
+			fileName := fmt.Sprintf("%v (%v)", job.FileName, n)
+			if existingFile(folder, fileName, exts) == "" {
+				log.Infof("%v already exists, saving as %v", existing, fileName)
+				job.FileName = fileName
+				job.state = &jobState{}
+				return job, "", nil
+			}
+		}
+	}
+	log.Warningf("Overwriting %v", existing)
+	job.state = &jobState{}
+	return job, "", nil
+}
+
+// jobState is shared by the copies of a job once its conflicts have been
+// resolved
+type jobState struct {
+	// subtitles is the path of the subtitles saved for the job, which
+	// are cut and shifted to match its video
+	subtitles string
+}
+
+// existingFile returns the first of the files named fileName plus one of
+// exts that exists in folder, or "" if none do
+func existingFile(folder string, fileName string, exts []string) string {
+	for _, ext := range exts {
+		path := filepath.Join(folder, fileName+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// fileSize returns the size of a file, or 0 if it cannot be read
+func fileSize(path string) int64 {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveConflicts(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		resume       bool
+		subOnly      bool
+		files        []string
+		wantFileName string
+		wantExisting string
+		wantErr      error
+	}{
+		{"nothing exists", ConflictFail, false, false, nil, "ep1", "", nil},
+		{"overwrite", ConflictOverwrite, false, false, []string{"ep1.mp4"}, "ep1", "", nil},
+		{"skip the video", ConflictSkip, false, false, []string{"ep1.mp4"}, "ep1", "ep1.mp4", nil},
+		{"skip the subtitles", ConflictSkip, false, false, []string{"ep1.srt"}, "ep1", "ep1.srt", nil},
+		{"skip a part file", ConflictSkip, false, false, []string{"ep1.mp4.part"}, "ep1", "ep1.mp4.part", nil},
+		{"resume a part file", ConflictSkip, true, false, []string{"ep1.mp4.part"}, "ep1", "", nil},
+		{"other format", ConflictFail, false, false, []string{"ep1.mkv"}, "ep1", "", nil},
+		{"subtitles only", ConflictSkip, false, true, []string{"ep1.mp4"}, "ep1", "", nil},
+		{"fail on the subtitles", ConflictFail, false, false, []string{"ep1.srt"}, "", "", ErrFileExists},
+		{"fail on subtitles only", ConflictFail, false, true, []string{"ep1.srt"}, "", "", ErrFileExists},
+		{"rename", ConflictRename, false, false, []string{"ep1.mp4", "ep1 (1).srt", "ep1 (2).mp4.part"}, "ep1 (3)", "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kdramadl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, name := range test.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("old"), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := &Downloader{Folder: dir, OnConflict: test.policy, Resume: test.resume}
+			job, existing, err := d.ResolveConflicts(Job{FileName: "ep1", Format: FormatMP4}, test.subOnly)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got error %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantExisting != "" {
+				test.wantExisting = filepath.Join(dir, test.wantExisting)
+			}
+			if existing != test.wantExisting {
+				t.Errorf("existing %q, want %q", existing, test.wantExisting)
+			}
+			if job.FileName != test.wantFileName {
+				t.Errorf("file name %q, want %q", job.FileName, test.wantFileName)
+			}
+			if existing == "" && job.state == nil {
+				t.Error("the job is not marked as resolved")
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+// container describes how ffmpeg writes one of the output Formats
+type container struct {
+	muxer string // ffmpeg output format
+	// videoCodecs and audioCodecs are the codecs that can be copied into
+	// the container without encoding them again. nil means any codec.
+	videoCodecs []string
+	audioCodecs []string
+	// videoEncoder and audioEncoder are used for streams that cannot be
+	// copied. The format is audio only if videoEncoder is blank.
+	videoEncoder string
+	audioEncoder string
+	// subCodec is the codec of muxed in subtitles, blank if the container
+	// cannot hold text subtitles
+	subCodec string
+	hardSubs bool // subtitles can be burned into the video
+	subFile  bool // the subtitles are kept next to the video
+	aacBSF   bool // copied aac needs the aac_adtstoasc filter
+	noAudio  bool // the format has no audio
+	// filter is the video filter of animations, which are always encoded
+	// with videoEncoder and extra output options args
+	filter string
+	args   []string
+}
+
+var (
+	mp4VideoCodecs = []string{"h264", "hevc", "mpeg4", "av1"}
+	mp4AudioCodecs = []string{"aac", "mp3", "ac3", "eac3", "alac", "opus", "flac"}
+)
+
+// containers holds the container of each of the Formats
+var containers = map[string]container{
+	FormatMKV: {
+		muxer:        "matroska",
+		videoEncoder: "libx264",
+		audioEncoder: "aac",
+		subCodec:     "copy",
+		aacBSF:       true,
+	},
+	FormatMP4: {
+		muxer:        "mp4",
+		videoCodecs:  mp4VideoCodecs,
+		audioCodecs:  mp4AudioCodecs,
+		videoEncoder: "libx264",
+		audioEncoder: "aac",
+		subCodec:     "mov_text",
+		hardSubs:     true,
+		subFile:      true,
+		aacBSF:       true,
+	},
+	FormatWebM: {
+		muxer:        "webm",
+		videoCodecs:  []string{"vp8", "vp9", "av1"},
+		audioCodecs:  []string{"opus", "vorbis"},
+		videoEncoder: "libvpx-vp9",
+		audioEncoder: "libopus",
+		subCodec:     "webvtt",
+		hardSubs:     true,
+		subFile:      true,
+	},
+	FormatMOV: {
+		muxer:        "mov",
+		videoCodecs:  append([]string{"prores"}, mp4VideoCodecs...),
+		audioCodecs:  []string{"aac", "mp3", "ac3", "eac3", "alac", "pcm_s16le"},
+		videoEncoder: "libx264",
+		audioEncoder: "aac",
+		subCodec:     "mov_text",
+		hardSubs:     true,
+		subFile:      true,
+		aacBSF:       true,
+	},
+	FormatTS: {
+		muxer:        "mpegts",
+		videoCodecs:  []string{"h264", "hevc", "mpeg2video"},
+		audioCodecs:  []string{"aac", "mp3", "ac3", "eac3", "opus"},
+		videoEncoder: "libx264",
+		audioEncoder: "aac",
+		hardSubs:     true,
+		subFile:      true,
+	},
+	FormatM4A: {
+		muxer:        "ipod",
+		audioCodecs:  []string{"aac", "alac"},
+		audioEncoder: "aac",
+		aacBSF:       true,
+	},
+	FormatMP3: {
+		muxer:        "mp3",
+		audioCodecs:  []string{"mp3"},
+		audioEncoder: "libmp3lame",
+	},
+	FormatOpus: {
+		muxer:        "opus",
+		audioCodecs:  []string{"opus"},
+		audioEncoder: "libopus",
+	},
+	FormatGIF: {
+		muxer:        "gif",
+		videoEncoder: "gif",
+		// a palette made for the clip looks much better than the default
+		filter:   "fps=10,scale=480:-1:flags=lanczos,split[a][b];[a]palettegen[p];[b][p]paletteuse",
+		hardSubs: true,
+		noAudio:  true,
+	},
+	FormatWebP: {
+		muxer:        "webp",
+		videoEncoder: "libwebp",
+		filter:       "fps=10,scale=480:-2:flags=lanczos",
+		args:         []string{"-loop", "0"},
+		hardSubs:     true,
+		noAudio:      true,
+	},
+}
+
+// audioOnly reports whether the container has no video
+func (c container) audioOnly() bool {
+	return c.videoEncoder == ""
+}
+
+// canCopy reports whether a stream with codec can be copied as it is into
+// a container that holds codecs. Unknown audio is copied if the container
+// holds aac, which is what the hosts serve.
+func canCopy(codec string, codecs []string) bool {
+	if codecs == nil {
+		return true
+	}
+	if codec == "" {
+		return stringInSlice("aac", codecs)
+	}
+	return stringInSlice(codec, codecs)
+}
+
+// muxer returns the ffmpeg output format name for a Format
+func muxer(format string) string {
+	return containers[format].muxer
+}
+
+// IsAudioFormat reports whether format saves only the audio
+func IsAudioFormat(format string) bool {
+	return containers[format].audioOnly()
+}
+
+// KeepsSubtitles reports whether the subtitles are left next to videos
+// saved in format. For other formats they are only muxed in, if at all.
+func KeepsSubtitles(format string) bool {
+	return containers[format].subFile
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// Errors returned by Downloader methods can be checked with errors.Is.
+// Use errors.As with *HTTPError or *FFmpegError for the details.
+var (
+	// ErrInvalidCode means the host does not know the download code
+	ErrInvalidCode = errors.New("Invalid Download Code")
+	// ErrResolutionUnavailable means the video is not available in the
+	// requested resolution
+	ErrResolutionUnavailable = errors.New("Resolution not available")
+	// ErrRateLimited means the host is refusing requests for now
+	ErrRateLimited = errors.New("Rate limited by host")
+	// ErrHostDown means the host could not be reached or has failed
+	ErrHostDown = errors.New("Host is down")
+	// ErrFFmpegFailed means ffmpeg exited with an error
+	ErrFFmpegFailed = errors.New("ffmpeg failed")
+	// ErrFileExists means an output file already exists and
+	// Downloader.OnConflict is ConflictFail
+	ErrFileExists = errors.New("File already exists")
+)
+
+// HTTPError is returned when the host answers a request with an error or
+// with a web page instead of a file
+type HTTPError struct {
+	URL         string
+	StatusCode  int
+	ContentType string // Set when a web page was returned
+	// Err is the reason if known: ErrInvalidCode, ErrResolutionUnavailable,
+	// ErrRateLimited or ErrHostDown
+	Err error
+}
+
+// newHTTPError creates an HTTPError for a response, with the reason set
+// from the status code if it tells
+func newHTTPError(response *http.Response) *HTTPError {
+	e := &HTTPError{URL: response.Request.URL.String(), StatusCode: response.StatusCode}
+	if contentType := response.Header.Get("Content-Type"); response.StatusCode < 400 &&
+		strings.Contains(contentType, "text/html") {
+		e.ContentType = contentType
+	}
+	switch {
+	case response.StatusCode == http.StatusTooManyRequests:
+		e.Err = ErrRateLimited
+	case response.StatusCode >= 500:
+		e.Err = ErrHostDown
+	}
+	return e
+}
+
+func (e *HTTPError) Error() string {
+	message := fmt.Sprintf("HTTP %v", e.StatusCode)
+	if e.ContentType != "" {
+		message = fmt.Sprintf("Unexpected Content-Type %q", e.ContentType)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %v", e.Err, message)
+	}
+	return message
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// temporary reports whether the request may succeed if retried
+func (e *HTTPError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusTooManyRequests
+}
+
+// notFound reports whether the host does not have what was requested
+func (e *HTTPError) notFound() bool {
+	return e.Err == nil && (e.ContentType != "" || e.StatusCode < 500)
+}
+
+// hostDown wraps an error from making a request
+func hostDown(err error) error {
+	return fmt.Errorf("%w: %v", ErrHostDown, err)
+}
+
+// FFmpegError is returned when ffmpeg exits with an error
+type FFmpegError struct {
+	ExitCode int    // -1 if ffmpeg did not exit normally
+	Stderr   string // What ffmpeg wrote to stderr, if captured
+	Err      error
+
+	network  bool // ffmpeg was reading from the network
+	captured bool // stderr was captured
+}
+
+// newFFmpegError creates an FFmpegError from the error of running ffmpeg
+func newFFmpegError(err error, stderr *bytes.Buffer) *FFmpegError {
+	e := &FFmpegError{ExitCode: -1, Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+	}
+	if stderr != nil {
+		e.Stderr = strings.TrimSpace(stderr.String())
+		e.captured = true
+	}
+	return e
+}
+
+func (e *FFmpegError) Error() string {
+	message := fmt.Sprintf("%v: %v", ErrFFmpegFailed, e.Err)
+	if e.ExitCode >= 0 {
+		message = fmt.Sprintf("%v with exit code %v", ErrFFmpegFailed, e.ExitCode)
+	}
+	if e.Stderr != "" {
+		// the last line usually says what went wrong
+		lines := strings.Split(e.Stderr, "\n")
+		message = fmt.Sprintf("%v: %v", message, strings.TrimSpace(lines[len(lines)-1]))
+	}
+	return message
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrFFmpegFailed) true for an FFmpegError
+func (e *FFmpegError) Is(target error) bool {
+	return target == ErrFFmpegFailed
+}
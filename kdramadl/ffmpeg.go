@@ -0,0 +1,335 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filterOptionEscaper and filterGraphEscaper escape a value for the two
+// levels at which ffmpeg parses a filter: its options and the filtergraph
+var (
+	filterOptionEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	filterGraphEscaper  = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`)
+)
+
+// escapeFilterPath escapes a path for use as a filter option, such as the
+// file of the subtitles filter. Paths like "C:\Videos\ep1 [720p].srt"
+// have characters that ffmpeg would otherwise take for separators.
+func escapeFilterPath(path string) string {
+	// ffmpeg accepts / on Windows too, which saves a level of backslashes
+	path = filepath.ToSlash(path)
+	return filterGraphEscaper.Replace(filterOptionEscaper.Replace(path))
+}
+
+// ffmpegJob holds the parameters for a single ffmpeg run
+type ffmpegJob struct {
+	logLevel    string
+	vidInput    string // URL or path of the video
+	subInput    string // path of the subtitles
+	local       bool   // vidInput is a local file
+	format      string
+	output      string
+	subFilePath string
+	hardSubs    bool
+	copyVideo   bool   // copy the video stream instead of encoding it
+	videoCodec  string // codec of the source video, if known
+	audioCodec  string // codec of the source audio, if known
+	progress    bool   // write progress to stdout instead of stats to stderr
+	// clipStart and clipEnd cut a clip out of the video, see Job
+	clipStart time.Duration
+	clipEnd   time.Duration
+	tags      Tags
+	// pass is 1 or 2 for a two-pass encode, with the statistics kept in
+	// passLogFile, and videoBitrate the bitrate to encode at
+	pass         int
+	passLogFile  string
+	videoBitrate string
+	// seek skips the start of the source. Timestamps are kept as they are
+	// in the source so that the output can be joined onto an earlier part.
+	seek time.Duration
+}
+
+// ffmpegCmd creates a Command for ffmpeg with the specified params.
+// Stderr is the terminal unless changed by the caller.
+func (d *Downloader) ffmpegCmd(f ffmpegJob) *exec.Cmd {
+
+	args := []string{"-loglevel", f.logLevel, "-stats", "-y"}
+	if f.progress {
+		args = []string{"-loglevel", f.logLevel, "-nostats", "-progress", "pipe:1", "-y"}
+	}
+	if !f.local {
+		args = append(args, []string{
+			"-timeout", fmt.Sprintf("%v", int64(d.timeout()/time.Microsecond)),
+			"-reconnect", "1", "-reconnect_streamed", "1"}...)
+		if d.Proxy != "" {
+			args = append(args, []string{"-http_proxy", d.Proxy}...)
+		}
+	}
+	var seekArgs []string
+	if f.seek > 0 {
+		seekArgs = []string{"-ss", formatSeconds(f.seek)}
+		args = append(args, "-copyts")
+	}
+	args = append(args, seekArgs...)
+	if f.clipStart > 0 {
+		// seeking the input only fetches the clip from the host
+		args = append(args, []string{"-ss", formatSeconds(f.clipStart)}...)
+	}
+	args = append(args, []string{"-i", f.vidInput}...)
+	c := containers[f.format]
+	var filters []string
+	if scale := d.Profile.scaleFilter(); scale != "" && !c.audioOnly() && c.filter == "" {
+		filters = append(filters, scale)
+	}
+	softSubs := c.subCodec != "" && !f.hardSubs
+	if softSubs {
+		// the first pass only looks at the video
+		if f.pass != 1 {
+			args = append(args, seekArgs...)
+			args = append(args, []string{"-i", f.subInput}...)
+		}
+	} else if f.hardSubs {
+		if _, err := os.Stat(f.subFilePath); !os.IsNotExist(err) {
+			vf := fmt.Sprintf("subtitles=%v", escapeFilterPath(f.subFilePath))
+			if d.HardSubsStyle != "" {
+				vf = fmt.Sprintf("subtitles=%v:force_style='%v'", escapeFilterPath(f.subFilePath), d.HardSubsStyle)
+			}
+			filters = append(filters, vf)
+		}
+	}
+	if c.filter != "" {
+		filters = append(filters, c.filter)
+	}
+	if len(filters) > 0 {
+		args = append(args, []string{"-vf", strings.Join(filters, ",")}...)
+	}
+	if c.audioOnly() {
+		args = append(args, "-vn")
+	} else if f.copyVideo {
+		args = append(args, []string{"-c:v", "copy"}...)
+		if f.videoCodec == "hevc" && (f.format == FormatMP4 || f.format == FormatMOV) {
+			// the tag Apple players need
+			args = append(args, []string{"-tag:v", "hvc1"}...)
+		}
+	} else if c.filter != "" {
+		args = append(args, []string{"-c:v", c.videoEncoder}...)
+		args = append(args, c.args...)
+	} else {
+		args = append(args, d.Profile.videoArgs(c.videoEncoder, f.videoBitrate)...)
+	}
+	if softSubs && f.pass != 1 {
+		args = append(args, []string{"-c:s", c.subCodec}...)
+	} else {
+		args = append(args, "-sn")
+	}
+	if f.clipEnd > 0 {
+		args = append(args, []string{"-t", formatSeconds(f.clipEnd - f.clipStart)}...)
+	}
+	if f.pass > 0 {
+		args = append(args, []string{
+			"-pass", strconv.Itoa(f.pass), "-passlogfile", f.passLogFile}...)
+	}
+	if f.pass == 1 {
+		// the first pass only writes the statistics for the second
+		args = append(args, []string{"-an", "-f", "null", os.DevNull}...)
+	} else {
+		audioArgs := d.Profile.audioArgs(c)
+		if c.noAudio {
+			audioArgs = []string{"-an"}
+		} else if audioArgs == nil && canCopy(f.audioCodec, c.audioCodecs) {
+			audioArgs = []string{"-c:a", "copy"}
+			if c.aacBSF && (f.audioCodec == "" || f.audioCodec == "aac") {
+				audioArgs = append(audioArgs, []string{"-bsf:a", "aac_adtstoasc"}...)
+			}
+		} else if audioArgs == nil {
+			audioArgs = []string{"-c:a", c.audioEncoder}
+		}
+		args = append(args, audioArgs...)
+		args = append(args, f.tags.args(c, softSubs)...)
+		args = append(args, []string{"-f", muxer(f.format), f.output}...)
+	}
+
+	ffmpegCmd := exec.Command(d.ffmpegPath(), args...)
+	ffmpegCmd.Stderr = os.Stderr
+	ffmpegCmd.Stdout = os.Stdout
+	return ffmpegCmd
+}
+
+// planCodecs decides whether the video can be copied into the container
+// or has to be encoded. Burned in subtitles, a Profile and codecs that the
+// container cannot hold need encoding, as does any video when ffprobe is
+// unable to tell the codec. mkv holds any codec and is not checked.
+// Clips that do not start at the beginning are encoded since copied video
+// can only be cut at keyframes, which would put the subtitles out of sync.
+func (d *Downloader) planCodecs(ctx context.Context, log Logger, f *ffmpegJob, input string) {
+	c := containers[f.format]
+	encodeVideo := c.audioOnly() || c.filter != "" || f.hardSubs || f.clipStart > 0 ||
+		d.Reencode || d.Profile != nil
+	if c.videoCodecs == nil && c.audioCodecs == nil {
+		f.copyVideo = !encodeVideo
+		return
+	}
+	video, audio, err := d.probeCodecs(ctx, input, !f.local)
+	if err != nil {
+		if encodeVideo {
+			log.Debugf("Unable to check the codecs: %v", err)
+		} else {
+			log.Warningf("Unable to check the video codec, encoding it again: %v", err)
+		}
+		return
+	}
+	f.videoCodec, f.audioCodec = video, audio
+	if encodeVideo {
+		return
+	}
+	if !canCopy(video, c.videoCodecs) {
+		log.Infof("Encoding the %v video again since %v cannot hold it", video, f.format)
+		return
+	}
+	log.Debugf("Copying the %v video into %v", video, f.format)
+	f.copyVideo = true
+}
+
+// length returns the length of the output for a source of length total,
+// or 0 if it is unknown
+func (f ffmpegJob) length(total time.Duration) time.Duration {
+	end := total
+	if f.clipEnd > 0 && (total == 0 || f.clipEnd < total) {
+		end = f.clipEnd
+	}
+	if end <= f.clipStart {
+		return 0
+	}
+	return end - f.clipStart
+}
+
+// formatSeconds formats a duration as seconds for ffmpeg arguments
+func formatSeconds(t time.Duration) string {
+	return strconv.FormatFloat(t.Seconds(), 'f', 3, 64)
+}
+
+func (d *Downloader) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return d.Timeout
+}
+
+func (d *Downloader) ffmpegPath() string {
+	if d.FFmpegPath == "" {
+		return "ffmpeg"
+	}
+	return d.FFmpegPath
+}
+
+// stopGracePeriod is how long ffmpeg is given to exit at each step of
+// shutting it down before escalating
+var stopGracePeriod = 5 * time.Second
+
+// runFFmpeg runs an ffmpeg command until it exits or ctx is done.
+// On cancellation ffmpeg is first asked to quit by sending "q" on stdin,
+// which lets it finalise the output file. If it is still running after
+// stopGracePeriod it is interrupted, and finally killed.
+func runFFmpeg(ctx context.Context, cmd *exec.Cmd, log Logger) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Errorf("Error starting command: %v", err.Error())
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Warningf("Stopping ffmpeg...")
+	io.WriteString(stdin, "q")
+	select {
+	case <-done:
+		return ctx.Err()
+	case <-time.After(stopGracePeriod):
+	}
+
+	// os.Interrupt is not supported on Windows, go straight to Kill there
+	if err := cmd.Process.Signal(os.Interrupt); err == nil {
+		log.Warningf("ffmpeg did not quit, interrupting")
+		select {
+		case <-done:
+			return ctx.Err()
+		case <-time.After(stopGracePeriod):
+		}
+	}
+	log.Warningf("ffmpeg did not stop, killing")
+	cmd.Process.Kill()
+	<-done
+	return ctx.Err()
+}
+
+// statsWriter collects the stderr output of an ffmpeg process that runs
+// alongside others. Stats lines are logged periodically through the job's
+// logger instead of being written straight to the terminal.
+type statsWriter struct {
+	log      Logger
+	line     []byte
+	lastLog  time.Time
+	interval time.Duration
+}
+
+func newStatsWriter(log Logger) *statsWriter {
+	return &statsWriter{log: log, interval: 10 * time.Second}
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		// -stats lines end with \r, everything else with \n
+		if b != '\r' && b != '\n' {
+			w.line = append(w.line, b)
+			continue
+		}
+		line := strings.TrimSpace(string(w.line))
+		w.line = w.line[:0]
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "frame=") && !strings.HasPrefix(line, "size=") {
+			w.log.Warningf("%v", line)
+		} else if time.Since(w.lastLog) >= w.interval {
+			w.log.Infof("%v", line)
+			w.lastLog = time.Now()
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,211 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscapeFilterPath(t *testing.T) {
+	tests := []struct{ path, want string }{
+		{"ep1.srt", "ep1.srt"},
+		{"/videos/ep1 [720p].srt", `/videos/ep1 \[720p\].srt`},
+		{"/videos/it's, here.srt", `/videos/it\\\'s\, here.srt`},
+		{"/videos/a;b.srt", `/videos/a\;b.srt`},
+		{"C:/Videos/ep1.srt", `C\\:/Videos/ep1.srt`},
+	}
+	for _, test := range tests {
+		if got := escapeFilterPath(test.path); got != test.want {
+			t.Errorf("escapeFilterPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestFfmpegCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	subs := filepath.Join(dir, "ep1[eng].srt")
+	if err := ioutil.WriteFile(subs, []byte("1\n00:00:01,000 --> 00:00:02,000\nHi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// remote is what every remote input starts with
+	const remote = "-loglevel fatal -stats -y -timeout 10000000 -reconnect 1 -reconnect_streamed 1 "
+	job := func(format string, change func(f *ffmpegJob)) ffmpegJob {
+		f := ffmpegJob{
+			logLevel: "fatal", vidInput: "http://host/ep1.m3u8", subInput: "ep1.srt", subFilePath: "ep1.srt",
+			format: format, output: "ep1." + format + ".part",
+		}
+		if change != nil {
+			change(&f)
+		}
+		return f
+	}
+	targetSize := &Profile{TargetSize: "300M"}
+	tests := []struct {
+		name    string
+		profile *Profile
+		job     ffmpegJob
+		want    string
+	}{
+		{"mkv copy", nil, job(FormatMKV, func(f *ffmpegJob) {
+			f.copyVideo = true
+			f.tags = Tags{Title: "Goblin", AudioLanguage: "kor", SubtitleLanguage: "eng"}
+		}), remote + "-i http://host/ep1.m3u8 -i ep1.srt -c:v copy -c:s copy -c:a copy -bsf:a aac_adtstoasc " +
+			"-metadata title=Goblin -metadata:s:a:0 language=kor -metadata:s:a:0 title=Korean " +
+			"-metadata:s:s:0 language=eng -metadata:s:s:0 title=English -f matroska ep1.mkv.part"},
+		{"mkv encode", nil, job(FormatMKV, nil),
+			remote + "-i http://host/ep1.m3u8 -i ep1.srt -c:v libx264 -c:s copy -c:a copy -bsf:a aac_adtstoasc -f matroska ep1.mkv.part"},
+		{"mp4 hevc copy", nil, job(FormatMP4, func(f *ffmpegJob) {
+			f.copyVideo, f.videoCodec, f.audioCodec = true, "hevc", "aac"
+		}), remote + "-i http://host/ep1.m3u8 -i ep1.srt -c:v copy -tag:v hvc1 -c:s mov_text -c:a copy -bsf:a aac_adtstoasc -f mp4 ep1.mp4.part"},
+		{"mp4 h264 copy", nil, job(FormatMP4, func(f *ffmpegJob) {
+			f.copyVideo, f.videoCodec, f.audioCodec = true, "h264", "aac"
+		}), remote + "-i http://host/ep1.m3u8 -i ep1.srt -c:v copy -c:s mov_text -c:a copy -bsf:a aac_adtstoasc -f mp4 ep1.mp4.part"},
+		{"mp4 hard subs", nil, job(FormatMP4, func(f *ffmpegJob) {
+			f.hardSubs, f.subFilePath = true, subs
+		}), remote + "-i http://host/ep1.m3u8 -vf subtitles=" + escapeFilterPath(subs) +
+			" -c:v libx264 -sn -c:a copy -bsf:a aac_adtstoasc -f mp4 ep1.mp4.part"},
+		{"mp3 encode", nil, job(FormatMP3, func(f *ffmpegJob) { f.audioCodec = "aac" }),
+			remote + "-i http://host/ep1.m3u8 -vn -sn -c:a libmp3lame -f mp3 ep1.mp3.part"},
+		{"mp3 copy", nil, job(FormatMP3, func(f *ffmpegJob) { f.audioCodec = "mp3" }),
+			remote + "-i http://host/ep1.m3u8 -vn -sn -c:a copy -f mp3 ep1.mp3.part"},
+		{"mp4 resume", nil, job(FormatMP4, func(f *ffmpegJob) {
+			f.copyVideo, f.seek, f.output = true, 42*time.Second, "ep1.mp4.part.resume"
+		}), remote + "-copyts -ss 42.000 -i http://host/ep1.m3u8 -ss 42.000 -i ep1.srt " +
+			"-c:v copy -c:s mov_text -c:a copy -bsf:a aac_adtstoasc -f mp4 ep1.mp4.part.resume"},
+		{"mp3 resume", nil, job(FormatMP3, func(f *ffmpegJob) { f.audioCodec, f.seek = "mp3", 90500*time.Millisecond }),
+			remote + "-copyts -ss 90.500 -i http://host/ep1.m3u8 -vn -sn -c:a copy -f mp3 ep1.mp3.part"},
+		{"gif clip", nil, job(FormatGIF, func(f *ffmpegJob) {
+			f.clipStart, f.clipEnd = 10*time.Second, 15*time.Second
+		}), remote + "-ss 10.000 -i http://host/ep1.m3u8 " +
+			"-vf fps=10,scale=480:-1:flags=lanczos,split[a][b];[a]palettegen[p];[b][p]paletteuse " +
+			"-c:v gif -sn -t 5.000 -an -f gif ep1.gif.part"},
+		{"webp clip", nil, job(FormatWebP, func(f *ffmpegJob) { f.clipEnd = 5 * time.Second }),
+			remote + "-i http://host/ep1.m3u8 -vf fps=10,scale=480:-2:flags=lanczos -c:v libwebp -loop 0 -sn -t 5.000 -an -f webp ep1.webp.part"},
+		{"two-pass first pass", targetSize, job(FormatMP4, func(f *ffmpegJob) {
+			f.vidInput, f.local, f.pass, f.passLogFile, f.videoBitrate = "ep1.mp4.download", true, 1, "ep1.passlog", "2000000"
+		}), "-loglevel fatal -stats -y -i ep1.mp4.download -c:v libx264 -b:v 2000000 -sn " +
+			"-pass 1 -passlogfile ep1.passlog -an -f null " + os.DevNull},
+		{"two-pass second pass", targetSize, job(FormatMP4, func(f *ffmpegJob) {
+			f.vidInput, f.local, f.pass, f.passLogFile, f.videoBitrate = "ep1.mp4.download", true, 2, "ep1.passlog", "2000000"
+		}), "-loglevel fatal -stats -y -i ep1.mp4.download -i ep1.srt -c:v libx264 -b:v 2000000 -c:s mov_text " +
+			"-pass 2 -passlogfile ep1.passlog -c:a copy -bsf:a aac_adtstoasc -f mp4 ep1.mp4.part"},
+		{"webm profile", &Profile{VideoCodec: "libvpx-vp9", CRF: 31, Preset: "fast", AudioCodec: "libopus", AudioBitrate: "96k", MaxHeight: 720},
+			job(FormatWebM, nil), remote + "-i http://host/ep1.m3u8 -i ep1.srt -vf scale=-2:'min(720,ih)' " +
+				"-c:v libvpx-vp9 -deadline good -cpu-used 3 -crf 31 -b:v 0 -c:s webvtt -c:a libopus -b:a 96k -f webm ep1.webm.part"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &Downloader{Profile: test.profile}
+			got := d.ffmpegCmd(test.job).Args[1:]
+			if want := strings.Fields(test.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got args\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+// writeScript writes a shell script standing in for ffmpeg or ffprobe
+// to dir and returns its path
+func writeScript(t *testing.T, dir, name, body string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script for " + name)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fakeFfprobe writes a script to dir that prints output like ffprobe,
+// or fails if output is blank
+func fakeFfprobe(t *testing.T, dir, output string) string {
+	if output == "" {
+		return writeScript(t, dir, "ffprobe", "exit 1\n")
+	}
+	return writeScript(t, dir, "ffprobe", "printf '%s\\n' '"+output+"'\n")
+}
+
+func TestPlanCodecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const (
+		h264 = "h264,video\naac,audio"
+		hevc = "hevc,video\naac,audio"
+	)
+	tests := []struct {
+		name       string
+		reencode   bool
+		profile    *Profile
+		format     string
+		change     func(f *ffmpegJob)
+		probed     string // output of ffprobe, blank if it fails
+		copyVideo  bool
+		videoCodec string
+		audioCodec string
+	}{
+		{"mkv copies without probing", false, nil, FormatMKV, nil, "", true, "", ""},
+		{"mkv reencode", true, nil, FormatMKV, nil, h264, false, "", ""},
+		{"mkv profile", false, &Profile{CRF: 23}, FormatMKV, nil, h264, false, "", ""},
+		{"mp4 h264", false, nil, FormatMP4, nil, h264, true, "h264", "aac"},
+		{"mp4 hevc", false, nil, FormatMP4, nil, hevc, true, "hevc", "aac"},
+		{"webm h264", false, nil, FormatWebM, nil, h264, false, "h264", "aac"},
+		{"webm vp9", false, nil, FormatWebM, nil, "vp9,video\nopus,audio", true, "vp9", "opus"},
+		{"mp4 probe fails", false, nil, FormatMP4, nil, "", false, "", ""},
+		{"mp4 no video stream", false, nil, FormatMP4, nil, "aac,audio", false, "", ""},
+		{"mp4 hard subs", false, nil, FormatMP4, func(f *ffmpegJob) { f.hardSubs = true }, h264, false, "h264", "aac"},
+		{"mp4 clip", false, nil, FormatMP4, func(f *ffmpegJob) { f.clipStart = time.Minute }, h264, false, "h264", "aac"},
+		{"mp4 clip from the start", false, nil, FormatMP4, func(f *ffmpegJob) { f.clipEnd = time.Minute }, h264, true, "h264", "aac"},
+		{"mp4 profile", false, &Profile{CRF: 23}, FormatMP4, nil, h264, false, "h264", "aac"},
+		{"mp3", false, nil, FormatMP3, nil, h264, false, "h264", "aac"},
+		{"gif encodes without probing", false, nil, FormatGIF, nil, h264, false, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &Downloader{Reencode: test.reencode, Profile: test.profile,
+				FFprobePath: fakeFfprobe(t, dir, test.probed)}
+			f := ffmpegJob{format: test.format, local: true}
+			if test.change != nil {
+				test.change(&f)
+			}
+			d.planCodecs(context.Background(), nopLogger{}, &f, "ep1.mp4.download")
+			if f.copyVideo != test.copyVideo || f.videoCodec != test.videoCodec || f.audioCodec != test.audioCodec {
+				t.Errorf("got copy %v, codecs %q and %q, want copy %v, codecs %q and %q", f.copyVideo,
+					f.videoCodec, f.audioCodec, test.copyVideo, test.videoCodec, test.audioCodec)
+			}
+		})
+	}
+}
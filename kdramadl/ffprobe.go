@@ -0,0 +1,162 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ffprobePath returns the ffprobe executable, which by default sits next to ffmpeg
+func (d *Downloader) ffprobePath() string {
+	if d.FFprobePath != "" {
+		return d.FFprobePath
+	}
+	dir, base := filepath.Split(d.ffmpegPath())
+	return dir + strings.Replace(base, "ffmpeg", "ffprobe", 1)
+}
+
+// probe runs ffprobe and returns its output
+func (d *Downloader) probe(ctx context.Context, args ...string) (string, error) {
+	args = append([]string{"-v", "error"}, args...)
+	output, err := exec.CommandContext(ctx, d.ffprobePath(), args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// probeDuration returns the duration of a media file. Files that were not
+// closed properly may have no duration in the header, in which case the
+// timestamp of the last video packet is used instead.
+func (d *Downloader) probeDuration(ctx context.Context, input string) (time.Duration, error) {
+	output, err := d.probe(ctx,
+		"-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", input)
+	if err == nil {
+		if duration, err := parseSeconds(output); err == nil && duration > 0 {
+			return duration, nil
+		}
+	}
+	output, err = d.probe(ctx,
+		"-select_streams", "v:0", "-show_entries", "packet=pts_time", "-of", "csv=p=0", input)
+	if err != nil {
+		return 0, err
+	}
+	timestamps := strings.Fields(output)
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		if duration, err := parseSeconds(timestamps[i]); err == nil {
+			return duration, nil
+		}
+	}
+	return 0, errors.New("no duration found")
+}
+
+// probeSourceDuration returns the duration of the video at a URL. Unlike
+// probeDuration it only reads the header, so it does not download the video.
+func (d *Downloader) probeSourceDuration(ctx context.Context, vidURL string) (time.Duration, error) {
+	args, err := d.remoteProbeArgs()
+	if err != nil {
+		return 0, err
+	}
+	args = append(args,
+		"-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", vidURL)
+	output, err := d.probe(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return parseSeconds(output)
+}
+
+// remoteProbeArgs returns the ffprobe options for reading from the host.
+// ffprobe only supports HTTP proxies, so other proxies give an error.
+func (d *Downloader) remoteProbeArgs() ([]string, error) {
+	args := []string{"-timeout", fmt.Sprintf("%v", int64(d.timeout()/time.Microsecond))}
+	if d.Proxy != "" {
+		proxyURL, err := url.Parse(d.Proxy)
+		if err != nil || !strings.HasPrefix(proxyURL.Scheme, "http") {
+			return nil, fmt.Errorf("ffprobe cannot use the proxy %v, only HTTP proxies are supported", d.Proxy)
+		}
+		args = append(args, "-http_proxy", d.Proxy)
+	}
+	return args, nil
+}
+
+// probeCodecs returns the codec names of the first video and audio streams
+// of a media file, or of the video at a URL if remote
+func (d *Downloader) probeCodecs(ctx context.Context, input string, remote bool) (string, string, error) {
+	var args []string
+	if remote {
+		var err error
+		if args, err = d.remoteProbeArgs(); err != nil {
+			return "", "", err
+		}
+	}
+	args = append(args,
+		"-show_entries", "stream=codec_type,codec_name", "-of", "csv=p=0", input)
+	output, err := d.probe(ctx, args...)
+	if err != nil {
+		return "", "", err
+	}
+	var video, audio string
+	for _, line := range strings.Fields(output) {
+		// each line is codec_name,codec_type
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[1] == "video" && video == "" {
+			video = fields[0]
+		} else if fields[1] == "audio" && audio == "" {
+			audio = fields[0]
+		}
+	}
+	if video == "" {
+		return "", "", errors.New("no video stream found")
+	}
+	return video, audio, nil
+}
+
+// probeStartTime returns the timestamp of the first packet in a media file
+func (d *Downloader) probeStartTime(ctx context.Context, input string) (time.Duration, error) {
+	output, err := d.probe(ctx,
+		"-show_entries", "format=start_time", "-of", "default=noprint_wrappers=1:nokey=1", input)
+	if err != nil {
+		return 0, err
+	}
+	return parseSeconds(output)
+}
+
+// parseSeconds parses ffprobe's decimal seconds, e.g. "12.345000"
+func parseSeconds(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRemoteProbeArgs(t *testing.T) {
+	tests := []struct {
+		proxy string
+		want  []string
+	}{
+		{"", []string{"-timeout", "5000000"}},
+		{"http://127.0.0.1:8080", []string{"-timeout", "5000000", "-http_proxy", "http://127.0.0.1:8080"}},
+		{"https://proxy.example.com", []string{"-timeout", "5000000", "-http_proxy", "https://proxy.example.com"}},
+		{"socks5://127.0.0.1:1080", nil},
+		{"127.0.0.1:8080", nil},
+	}
+	for _, test := range tests {
+		d := &Downloader{Proxy: test.proxy, Timeout: 5 * time.Second}
+		got, err := d.remoteProbeArgs()
+		if test.want == nil && err == nil {
+			t.Errorf("%q: got %q, want an error", test.proxy, got)
+		} else if test.want != nil && (err != nil || !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("%q: got %q and error %v, want %q", test.proxy, got, err, test.want)
+		}
+	}
+}
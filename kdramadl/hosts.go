@@ -0,0 +1,91 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultHosts are the hosts used when Downloader.Hosts is empty
+var DefaultHosts = []string{HostMain, HostAlt}
+
+// hosts returns the hosts in order of preference
+func (d *Downloader) hosts() []string {
+	if len(d.Hosts) == 0 {
+		return DefaultHosts
+	}
+	return d.Hosts
+}
+
+// host returns the host that requests are sent to
+func (d *Downloader) host() string {
+	hosts := d.hosts()
+	d.hostMutex.Lock()
+	defer d.hostMutex.Unlock()
+	return hosts[d.hostIndex%len(hosts)]
+}
+
+// hostURL returns the base URL of a host, which is either a hostname
+// or a URL such as http://127.0.0.1:8080/
+func hostURL(host string) string {
+	if strings.Contains(host, "://") {
+		return strings.TrimSuffix(host, "/") + "/"
+	}
+	return fmt.Sprintf("https://%v/", host)
+}
+
+// currentURL points a URL on any of the hosts to the host in use, so that
+// a download continues on the new host after a failover
+func (d *Downloader) currentURL(rawURL string) string {
+	for _, host := range d.hosts() {
+		if base := hostURL(host); strings.HasPrefix(rawURL, base) {
+			return d.baseURL() + strings.TrimPrefix(rawURL, base)
+		}
+	}
+	return rawURL
+}
+
+// hostFailed reports whether err is a reason to try another host: the host
+// is down, is rate limiting, or serves a web page instead of the file
+func hostFailed(err error) bool {
+	if errors.Is(err, ErrHostDown) || errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.ContentType != ""
+}
+
+// failover moves on to the next host after host failed with err. Nothing
+// changes if another job has already moved on from host. It returns false
+// if there is no other host to try.
+func (d *Downloader) failover(job Job, host string, err error) bool {
+	hosts := d.hosts()
+	if len(hosts) < 2 {
+		return false
+	}
+	d.hostMutex.Lock()
+	defer d.hostMutex.Unlock()
+	if hosts[d.hostIndex%len(hosts)] == host {
+		d.hostIndex = (d.hostIndex + 1) % len(hosts)
+		d.logger(job).Warningf("%v failed (%v), switching to %v", host, err, hosts[d.hostIndex])
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failoverDownloader returns a Downloader for a dead host followed by a
+// good one that serves content, with retries turned off so that only a
+// failover can save the download
+func failoverDownloader(connections int, content []byte) (*Downloader, func()) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/subs/abc.srt":
+			w.Write(content)
+		case "/videos/abc-720p.mp4":
+			http.ServeContent(w, r, "abc-720p.mp4", time.Time{}, bytes.NewReader(content))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	d := testDownloader(connections)
+	d.Retries = 0
+	d.Hosts = []string{dead.URL, good.URL}
+	d.Provider = &TemplateProvider{
+		Subtitles: "subs/{code}.srt",
+		Video:     "videos/{code}-{quality}.mp4",
+		Qualities: []string{"720p"},
+	}
+	return d, good.Close
+}
+
+func TestFailoverNative(t *testing.T) {
+	for _, connections := range []int{1, 2} {
+		t.Run(fmt.Sprintf("%v connections", connections), func(t *testing.T) {
+			content := testContent(2*minSegmentSize + 1)
+			d, closeServer := failoverDownloader(connections, content)
+			defer closeServer()
+			testFetch(t, d, d.VideoURL("abc", "720p"), content)
+			if host := d.host(); host != d.Hosts[1] {
+				t.Errorf("downloading from %v, want %v", host, d.Hosts[1])
+			}
+		})
+	}
+}
+
+func TestFailoverSubtitles(t *testing.T) {
+	content := []byte("1\n00:00:01,000 --> 00:00:02,000\nHello\n")
+	d, closeServer := failoverDownloader(1, content)
+	defer closeServer()
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d.Folder = dir
+
+	result, err := d.DownloadSubtitles(context.Background(), Job{Code: "abc", FileName: "ep1"})
+	if err != nil {
+		t.Fatalf("DownloadSubtitles: %v", err)
+	}
+	if want := filepath.Join(dir, "ep1.srt"); result.Path != want {
+		t.Errorf("saved as %v, want %v", result.Path, want)
+	}
+	data, err := ioutil.ReadFile(result.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("saved %q, want %q", data, content)
+	}
+	if host := d.host(); host != d.Hosts[1] {
+		t.Errorf("downloading from %v, want %v", host, d.Hosts[1])
+	}
+}
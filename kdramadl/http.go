@@ -0,0 +1,198 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fetch downloads rawURL into filePath and returns the SHA-256 checksum of
+// the file. If resume is set, the download continues from the bytes already
+// in filePath using a Range request. Failed requests are retried up to
+// d.Retries times, each time continuing from where the last one stopped.
+// With d.Connections > 1 the file is fetched in segments over several
+// connections if the server supports Range requests.
+func (d *Downloader) fetch(
+	ctx context.Context, job Job, rawURL string, filePath string, resume bool,
+	tracker *progressTracker) (string, error) {
+
+	log := d.logger(job)
+	statePath := filePath + segmentsExt
+	if !resume {
+		os.Remove(filePath)
+		os.Remove(statePath)
+	}
+
+	var err error
+	if state, loadErr := loadSegments(statePath); loadErr == nil {
+		// continue an interrupted segmented download
+		log.Infof("Resuming segmented download of %v", filePath)
+		err = d.fetchSegments(ctx, job, rawURL, filePath, state, tracker)
+	} else if _, statErr := os.Stat(filePath); d.Connections > 1 && os.IsNotExist(statErr) {
+		size, ok := d.rangeSupport(ctx, job, rawURL)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if ok {
+			err = d.fetchSegments(ctx, job, rawURL, filePath, newSegments(size, d.Connections), tracker)
+		} else {
+			log.Infof("Server does not support Range requests, using a single connection")
+			err = d.withRetries(ctx, job, "download", func() error {
+				return d.fetchOnce(ctx, log, d.currentURL(rawURL), filePath, tracker)
+			})
+		}
+	} else {
+		err = d.withRetries(ctx, job, "download", func() error {
+			return d.fetchOnce(ctx, log, d.currentURL(rawURL), filePath, tracker)
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	return fileChecksum(filePath)
+}
+
+// fetchOnce makes a single request for rawURL, appending to filePath
+func (d *Downloader) fetchOnce(
+	ctx context.Context, log Logger, rawURL string, filePath string, tracker *progressTracker) error {
+
+	var offset int64
+	if stat, err := os.Stat(filePath); err == nil {
+		offset = stat.Size()
+	}
+	request, _ := http.NewRequest("GET", rawURL, nil)
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", d.userAgent())
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+		log.Debugf("Requesting %v from byte %v", rawURL, offset)
+	} else {
+		log.Debugf("Requesting %v", rawURL)
+	}
+	response, err := d.client().Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return hostDown(err)
+	}
+	defer response.Body.Close()
+
+	total := int64(-1)
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// nothing left to download if the file is already complete
+		if _, size, ok := parseContentRange(response.Header.Get("Content-Range")); ok && size == offset {
+			log.Debugf("%v is already complete", filePath)
+			tracker.setTotal(size)
+			tracker.setBytes(size)
+			return nil
+		}
+		os.Remove(filePath)
+		return newHTTPError(response)
+	case response.StatusCode >= 400:
+		return newHTTPError(response)
+	case strings.Contains(response.Header.Get("Content-Type"), "text/html"):
+		return newHTTPError(response)
+	case response.StatusCode == http.StatusPartialContent:
+		start, size, ok := parseContentRange(response.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			return fmt.Errorf(
+				"Unexpected Content-Range %q", response.Header.Get("Content-Range"))
+		}
+		total = size
+		flags |= os.O_APPEND
+	default:
+		// the server ignored the Range header and is sending everything
+		if offset > 0 {
+			log.Debugf("Server does not support resuming, starting over")
+		}
+		offset = 0
+		if response.ContentLength >= 0 {
+			total = response.ContentLength
+		}
+		flags |= os.O_TRUNC
+	}
+
+	if total > 0 {
+		tracker.setTotal(total)
+	}
+	tracker.setBytes(offset)
+	output, err := os.OpenFile(filePath, flags, 0666)
+	if err != nil {
+		return err
+	}
+	received, err := io.Copy(countingWriter{output, tracker}, response.Body)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if total >= 0 && offset+received != total {
+		return fmt.Errorf("Incomplete download: received %v of %v bytes", offset+received, total)
+	}
+	return nil
+}
+
+// parseContentRange parses "bytes start-end/size" or "bytes */size"
+func parseContentRange(contentRange string) (start int64, size int64, ok bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(contentRange, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if parts[0] == "*" {
+		return 0, size, true
+	}
+	start, err = strconv.ParseInt(strings.SplitN(parts[0], "-", 2)[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of a file
+func fileChecksum(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,785 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package kdramadl downloads videos and subtitles from goplay.anontpp.com
+// and its mirror.
+//
+// A Downloader holds the settings shared by all downloads, and a Job
+// describes a single episode:
+//
+//	d := &kdramadl.Downloader{FFmpegPath: "ffmpeg"}
+//	job := kdramadl.Job{Code: "...", FileName: "ep01", Resolution: "720p"}
+//	if err := job.Validate(); err != nil {
+//		return err
+//	}
+//	result, err := d.DownloadVideo(context.Background(), job)
+package kdramadl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats
+const (
+	FormatMKV  = "mkv"
+	FormatMP4  = "mp4"
+	FormatWebM = "webm"
+	FormatMOV  = "mov"
+	FormatTS   = "ts"
+	FormatM4A  = "m4a"
+	FormatMP3  = "mp3"
+	FormatOpus = "opus"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+)
+
+// Formats lists the supported output formats. The first one is the default.
+var Formats = []string{
+	FormatMKV, FormatMP4, FormatWebM, FormatMOV, FormatTS,
+	FormatM4A, FormatMP3, FormatOpus, FormatGIF, FormatWebP,
+}
+
+// Known hosts
+const (
+	HostMain = "goplay.anontpp.com"
+	HostAlt  = "kdrama.armsasuncion.com"
+)
+
+// DefaultUserAgent is the User-Agent sent with every request
+const DefaultUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:10.0) Gecko/20150101 Firefox/47.0 (Chrome)"
+
+var validResRegex = regexp.MustCompile(`^([0-9]{3,4}p[+]?|[1-9])$`)
+
+// Job describes a single download
+type Job struct {
+	Code       string // Download Code
+	FileName   string // Filename to save as (without extension), may include subfolders
+	Resolution string // Resolution of video, e.g. 720p, or ResolutionBest or ResolutionWorst
+	Format     string // One of Formats
+	Folder     string // Download folder, overrides Downloader.Folder
+	HardSubs   bool   // Burn in subtitles, ignored for mkv and audio formats
+
+	// ClipStart and ClipEnd cut a clip out of the video. A ClipEnd of 0
+	// means the end of the video. Clips are needed for FormatGIF and
+	// FormatWebP.
+	ClipStart time.Duration
+	ClipEnd   time.Duration
+
+	// Tags are written into the container
+	Tags Tags
+
+	state *jobState // set by Downloader.ResolveConflicts
+
+	// Logger receives the messages for this job. Defaults to Downloader.Logger.
+	Logger Logger
+}
+
+// String returns a short description of the job for log messages
+func (j Job) String() string {
+	return fmt.Sprintf("%q (%v)", j.FileName, j.Code)
+}
+
+// IsClip reports whether only a part of the video is downloaded
+func (j Job) IsClip() bool {
+	return j.ClipStart > 0 || j.ClipEnd > 0
+}
+
+// Validate checks the job values and fills in the default format.
+// Use Downloader.Validate to also check the code with the provider.
+func (j *Job) Validate() error {
+	if j.Code == "" {
+		return errors.New("Download Code cannot be blank")
+	}
+	if j.FileName == "" {
+		return errors.New("Filename cannot be blank")
+	} else if clean := filepath.Clean(j.FileName); filepath.IsAbs(clean) ||
+		clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Filename must be inside the download folder: %v", j.FileName)
+	}
+	if j.Resolution == "" {
+		return errors.New("Resolution cannot be blank")
+	} else if j.Resolution != ResolutionBest && j.Resolution != ResolutionWorst &&
+		validResRegex.MatchString(j.Resolution) != true {
+		return fmt.Errorf("Invalid resolution: %v", j.Resolution)
+	}
+	if j.Format == "" {
+		j.Format = Formats[0]
+	} else if stringInSlice(j.Format, Formats) != true {
+		return fmt.Errorf("Invalid format: %v", j.Format)
+	}
+	if j.ClipStart < 0 || j.ClipEnd < 0 || (j.ClipEnd > 0 && j.ClipEnd <= j.ClipStart) {
+		return fmt.Errorf("Invalid clip: %v to %v", j.ClipStart, j.ClipEnd)
+	}
+	if containers[j.Format].filter != "" && j.ClipEnd == 0 {
+		return fmt.Errorf("%v needs the end of the clip", j.Format)
+	}
+	return j.Tags.check()
+}
+
+// Downloader holds the settings shared by all jobs.
+// The zero value is usable and downloads from HostMain with http.DefaultClient
+// and the ffmpeg found in PATH into the current folder.
+type Downloader struct {
+	Hosts          []string      // Hostnames or base URLs to fail over between, defaults to DefaultHosts
+	Provider       Provider      // Builds the download URLs, defaults to GoPlay
+	Client         *http.Client  // HTTP client, defaults to http.DefaultClient
+	FFmpegPath     string        // Path to the ffmpeg executable, defaults to "ffmpeg"
+	FFprobePath    string        // Path to ffprobe, defaults to ffprobe next to FFmpegPath
+	Folder         string        // Default download folder
+	Proxy          string        // HTTP proxy passed on to ffmpeg and ffprobe
+	Timeout        time.Duration // ffmpeg connection timeout, defaults to 10s
+	HardSubsStyle  string        // ASS style for hard subs and SubtitleASS, e.g. "FontSize=22"
+	SubtitleFormat string        // One of SubtitleFormats, defaults to SubtitleSRT
+	SubtitleOffset time.Duration // Added to the subtitle times, after SubtitleScale
+	SubtitleScale  float64       // Subtitle times are multiplied by this, e.g. 25/23.976
+	UserAgent      string        // Defaults to DefaultUserAgent
+	Verbose        bool          // Show ffmpeg warnings
+	Resume         bool          // Continue from an existing .part or .download file
+	Reencode       bool          // Always encode the video again, even if it could be copied
+	Retries        int           // Number of times a failed request or ffmpeg run is retried
+	RetryBackoff   time.Duration // First retry delay, doubled for each retry, defaults to 1s
+	RetryMaxDelay  time.Duration // Longest retry delay, defaults to 30s
+	RetryJitter    float64       // Fraction of the retry delay to randomly add or take away
+	Connections    int           // Number of parallel connections with Native
+	OnConflict     string        // One of ConflictPolicies for files that already exist
+
+	// Profile sets how the video is encoded. A TargetSize needs Native.
+	Profile *Profile
+
+	// OnProgress is called regularly with the progress of a job
+	OnProgress func(Job, Progress)
+
+	// OnRetry is called when a failed download or ffmpeg run is retried
+	OnRetry func(Job, Retry)
+
+	// Native downloads the video with Client into a .download file and only
+	// uses ffmpeg to mux it locally, instead of having ffmpeg fetch it.
+	Native bool
+
+	// Parallel should be set when several jobs run at the same time. ffmpeg
+	// stats are then logged per job instead of written to the terminal.
+	Parallel bool
+
+	// Logger receives messages for jobs that do not have their own Logger
+	Logger Logger
+
+	hostMutex sync.Mutex
+	hostIndex int // index in hosts() of the host in use
+}
+
+// SubtitleResult describes saved subtitles
+type SubtitleResult struct {
+	Path     string
+	Size     int64
+	FileName string   // Job.FileName the subtitles were saved as, changed by ConflictRename
+	Skipped  bool     // The file already existed and OnConflict is ConflictSkip
+	Repairs  []string // What was fixed in the subtitles served by the host
+}
+
+// VideoResult describes a saved video
+type VideoResult struct {
+	Path         string
+	Size         int64
+	SubtitlePath string // Subtitles saved alongside the video, if any
+	SHA256       string // Checksum of the saved video
+	SourceSHA256 string // Checksum of the downloaded source, with Native only
+	Elapsed      time.Duration
+	FileName     string // Job.FileName the video was saved as, changed by ConflictRename
+	Skipped      bool   // A file already existed and OnConflict is ConflictSkip
+}
+
+// Validate checks the job values, the Downloader options and the code with the provider
+func (d *Downloader) Validate(job *Job) error {
+	if err := job.Validate(); err != nil {
+		return err
+	}
+	if d.OnConflict != "" && !stringInSlice(d.OnConflict, ConflictPolicies) {
+		return fmt.Errorf("Invalid conflict policy: %v", d.OnConflict)
+	}
+	if !stringInSlice(d.subtitleFormat(), SubtitleFormats) {
+		return fmt.Errorf("Invalid subtitle format: %v", d.SubtitleFormat)
+	}
+	if d.SubtitleScale < 0 {
+		return fmt.Errorf("Invalid subtitle scale: %v", d.SubtitleScale)
+	}
+	if d.subtitleFormat() == SubtitleASS {
+		if _, _, err := assStyle(d.HardSubsStyle); err != nil {
+			return fmt.Errorf("Invalid subtitle style: %v", err)
+		}
+	}
+	if d.Profile != nil {
+		if err := d.Profile.Check(); err != nil {
+			return fmt.Errorf("Invalid profile: %v", err)
+		}
+		if d.Profile.TargetSize != "" && !d.Native {
+			return errors.New("A target size needs the native downloader")
+		}
+		if c := containers[job.Format]; d.Profile.TargetSize != "" && (c.audioOnly() || c.noAudio) {
+			return fmt.Errorf("A target size cannot be used with %v", job.Format)
+		}
+	}
+	return d.provider().Validate(job.Code)
+}
+
+// SubtitleURL returns the subtitle download URL for a code
+func (d *Downloader) SubtitleURL(code string) string {
+	return d.resolve(d.provider().SubtitleURL(code))
+}
+
+// VideoURL returns the video download URL for a code and resolution
+func (d *Downloader) VideoURL(code string, resolution string) string {
+	return d.resolve(d.provider().VideoURL(code, resolution))
+}
+
+// DownloadSubtitles saves the subtitles for a job as FileName.srt, or with
+// the extension of SubtitleFormat
+func (d *Downloader) DownloadSubtitles(ctx context.Context, job Job) (*SubtitleResult, error) {
+	log := d.logger(job)
+	folder, err := d.folder(job)
+	if err != nil {
+		return nil, err
+	}
+	if job.state == nil {
+		resolved, existing, err := d.ResolveConflicts(job, true)
+		if err != nil {
+			return nil, err
+		} else if existing != "" {
+			return &SubtitleResult{Path: existing, Size: fileSize(existing), FileName: job.FileName, Skipped: true}, nil
+		}
+		job = resolved
+	}
+	subURL := d.SubtitleURL(job.Code)
+	subFilePath := filepath.Join(folder, fmt.Sprintf("%v.%v", job.FileName, d.subtitleFormat()))
+
+	var data []byte
+	err = d.withRetries(ctx, job, "subtitles", func() error {
+		data, err = d.fetchSubtitles(ctx, log, d.currentURL(subURL))
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("Error downloading subtitles: %w", err)
+	}
+	size, repairs, err := d.saveSubtitles(log, job, data, subFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving subtitles: %w", err)
+	}
+	job.state.subtitles = subFilePath
+	log.Infof("Saved subtitles: %v", subFilePath)
+	return &SubtitleResult{Path: subFilePath, Size: size, FileName: job.FileName, Repairs: repairs}, nil
+}
+
+// fetchSubtitles makes a single request for the subtitles
+func (d *Downloader) fetchSubtitles(ctx context.Context, log Logger, subURL string) ([]byte, error) {
+
+	request, _ := http.NewRequest("GET", subURL, nil)
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", d.userAgent())
+	log.Debugf("Requesting %v", subURL)
+	response, err := d.client().Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, hostDown(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 400 ||
+		strings.Contains(response.Header.Get("content-type"), "text/html") {
+		httpErr := newHTTPError(response)
+		if httpErr.notFound() {
+			// the subtitle URL depends only on the code
+			httpErr.Err = ErrInvalidCode
+		}
+		return nil, httpErr
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// saveSubtitles repairs and shifts the SubRip subtitles in data, cuts them
+// to the job's clip and writes them to subFilePath, converted to
+// SubtitleFormat. SubRip subtitles that needed no changes are saved as
+// they are.
+func (d *Downloader) saveSubtitles(log Logger, job Job, data []byte, subFilePath string) (int64, []string, error) {
+	subs, repairs, err := RepairSRT(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, repair := range repairs {
+		log.Warningf("Subtitles: %v", repair)
+	}
+	shift := d.SubtitleOffset != 0 || (d.SubtitleScale != 0 && d.SubtitleScale != 1)
+	if shift {
+		removed := subs.Shift(d.SubtitleOffset, d.SubtitleScale)
+		log.Infof("Shifted subtitles by %v, scaled by %v", d.SubtitleOffset, d.subtitleScale())
+		if removed > 0 {
+			log.Warningf("Subtitles: removed %v that ended before the video starts", countCues(removed))
+		}
+	}
+	if job.IsClip() {
+		removed := subs.Clip(job.ClipStart, job.ClipEnd)
+		log.Debugf("Subtitles: removed %v outside the clip", countCues(removed))
+	}
+	if d.subtitleFormat() != SubtitleSRT || len(repairs) > 0 || shift || job.IsClip() {
+		var converted bytes.Buffer
+		if err := subs.Write(&converted, d.subtitleFormat(), d.HardSubsStyle); err != nil {
+			return 0, nil, err
+		}
+		data = converted.Bytes()
+	}
+	if err := ioutil.WriteFile(subFilePath, data, 0666); err != nil {
+		// don't leave incomplete subtitles behind
+		os.Remove(subFilePath)
+		return 0, nil, err
+	}
+	return int64(len(data)), repairs, nil
+}
+
+// DownloadVideo saves the video for a job as FileName.Format, or only the
+// clip if the job has one. Subtitles are muxed in as soft subs, or burned
+// in with HardSubs. They are downloaded, cut to the clip and shifted for
+// the job unless DownloadSubtitles has already saved them for the same
+// resolved job.
+func (d *Downloader) DownloadVideo(ctx context.Context, job Job) (*VideoResult, error) {
+	log := d.logger(job)
+	started := time.Now()
+	result := &VideoResult{}
+	if err := d.PickResolution(ctx, &job); err != nil {
+		return nil, err
+	}
+	folder, err := d.folder(job)
+	if err != nil {
+		return nil, err
+	}
+	if job.state == nil {
+		resolved, existing, err := d.ResolveConflicts(job, false)
+		if err != nil {
+			return nil, err
+		} else if existing != "" {
+			return &VideoResult{Path: existing, Size: fileSize(existing), FileName: job.FileName, Skipped: true}, nil
+		}
+		job = resolved
+	}
+	vidURL := d.VideoURL(job.Code, job.Resolution)
+	log.Debugf(
+		"Download Code: %v, Resolution: %v, Filename: %v, Format: %v, Folder: %v, Proxy: %v, Hard Subs: %v, Hard Subs Style: %v",
+		job.Code, job.Resolution, job.FileName, job.Format, folder, d.Proxy,
+		job.HardSubs, d.HardSubsStyle)
+	if job.IsClip() {
+		log.Infof("Cutting a clip from %v to %v", job.ClipStart, clipEnd(job.ClipEnd))
+	}
+
+	subFilePath := filepath.Join(folder, fmt.Sprintf("%v.%v", job.FileName, d.subtitleFormat()))
+	vidFilePath := filepath.Join(folder, fmt.Sprintf("%v.%v", job.FileName, job.Format))
+	// part file is the intermediary temp file generated by ffmpeg which will
+	// be renamed to the actual vid file name (vidFilePath)
+	partFilePath := filepath.Join(folder, fmt.Sprintf("%v.%v.part", job.FileName, job.Format))
+
+	c := containers[job.Format]
+	burnSubs := c.hardSubs && job.HardSubs
+	// audio and formats without text subtitles get none unless burned in
+	needSubs := burnSubs || c.subCodec != ""
+	// subtitles that were only fetched to be muxed in are removed afterwards
+	removeSubs := false
+	// subtitles are checked and repaired before ffmpeg gets them, so they
+	// are muxed in from a local file. Native downloads fetch them after
+	// the video. Subtitles already on disk are only used if they were
+	// saved for this job, as others may not match its clip or shift.
+	savedSubs := job.state.subtitles == subFilePath
+	if needSubs && !savedSubs && (burnSubs || !d.Native) {
+		if _, err := d.DownloadSubtitles(ctx, job); err != nil {
+			return nil, err
+		}
+		removeSubs = !c.subFile
+		savedSubs = true
+	}
+
+	ffmpegLogLevel := "fatal"
+	if d.Verbose {
+		ffmpegLogLevel = "warning"
+	}
+	ffJob := ffmpegJob{
+		logLevel:    ffmpegLogLevel,
+		vidInput:    vidURL,
+		subInput:    subFilePath,
+		format:      job.Format,
+		output:      partFilePath,
+		subFilePath: subFilePath,
+		hardSubs:    burnSubs,
+		clipStart:   job.ClipStart,
+		clipEnd:     job.ClipEnd,
+		tags:        job.Tags,
+	}
+
+	// the source file is the raw video fetched by the native downloader
+	srcFilePath := filepath.Join(folder, fmt.Sprintf("%v.%v.download", job.FileName, job.Format))
+	// the rest of an interrupted download is saved to the resume file and
+	// then joined onto the part file
+	resumeFilePath := partFilePath + ".resume"
+	var resumeFrom time.Duration
+
+	if d.Native {
+		log.Infof("Downloading %v", srcFilePath)
+		tracker := d.startProgress(job, StageDownload, 0)
+		checksum, err := d.fetch(ctx, job, vidURL, srcFilePath, d.Resume, tracker)
+		tracker.finish(err == nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				reportLeftovers(log, subFilePath, srcFilePath, srcFilePath+segmentsExt)
+				return nil, ctx.Err()
+			}
+			var httpErr *HTTPError
+			if errors.As(err, &httpErr) {
+				d.explainNotFound(ctx, job, httpErr)
+			}
+			return nil, fmt.Errorf("Error downloading video: %w", err)
+		}
+		result.SourceSHA256 = checksum
+		log.Debugf("SHA-256 of %v: %v", srcFilePath, checksum)
+		if needSubs && !savedSubs {
+			if _, err := d.DownloadSubtitles(ctx, job); err != nil {
+				return nil, err
+			}
+			removeSubs = !c.subFile
+		}
+		ffJob.vidInput = srcFilePath
+		ffJob.local = true
+	} else {
+		// a clip is short and starts at its own offset, so it is not resumed
+		if d.Resume && !job.IsClip() {
+			resumeFrom = d.resumePosition(ctx, log, job.Format, partFilePath, resumeFilePath)
+		} else {
+			os.Remove(resumeFilePath)
+		}
+		if resumeFrom > 0 {
+			log.Infof("Resuming %v from %v", partFilePath, resumeFrom)
+			ffJob.output = resumeFilePath
+			ffJob.seek = resumeFrom
+		}
+	}
+	if ffJob.local {
+		d.planCodecs(ctx, log, &ffJob, ffJob.vidInput)
+	} else {
+		d.planCodecs(ctx, log, &ffJob, d.currentURL(vidURL))
+	}
+	if err := d.planTargetSize(ctx, log, &ffJob, ffJob.vidInput); err != nil {
+		return nil, err
+	}
+
+	var tracker *progressTracker
+	if d.OnProgress != nil {
+		// the duration is needed to tell how far ffmpeg has got
+		var duration time.Duration
+		var err error
+		if ffJob.local {
+			duration, err = d.probeDuration(ctx, ffJob.vidInput)
+		} else {
+			duration, err = d.probeSourceDuration(ctx, d.currentURL(vidURL))
+		}
+		if err != nil {
+			log.Debugf("Unable to get the video duration: %v", err)
+		}
+		ffJob.progress = true
+		tracker = d.startProgress(job, StageFFmpeg, ffJob.length(duration))
+	}
+	if !ffJob.local {
+		log.Debugf("Requesting %v", vidURL)
+	}
+	passes := []int{0}
+	if ffJob.passLogFile != "" {
+		passes = []int{1, 2}
+	}
+	for _, pass := range passes {
+		ffJob.pass = pass
+		if pass > 0 {
+			log.Infof("Encoding pass %v of 2", pass)
+		}
+		attempt := 0
+		err = d.withRetries(ctx, job, "ffmpeg", func() error {
+			attempt++
+			if !ffJob.local {
+				ffJob.vidInput = d.currentURL(vidURL)
+			}
+			var ffmpegOutput *bytes.Buffer
+			if attempt > 1 && ffJob.logLevel == "fatal" {
+				// Retry with a more verbose loglevel
+				ffJob.logLevel = "warning"
+			}
+			ffmpegCmd := d.ffmpegCmd(ffJob)
+			if pass == 1 && tracker != nil {
+				// progress is only shown for the pass that writes the video
+				ffmpegCmd.Stdout = ioutil.Discard
+			} else if tracker != nil {
+				ffmpegCmd.Stdout = &ffmpegProgressWriter{tracker: tracker}
+			}
+			if attempt > 1 {
+				// capture stderr so that we can log it
+				ffmpegOutput = &bytes.Buffer{}
+				ffmpegCmd.Stderr = ffmpegOutput
+			} else if d.Parallel {
+				// keep the stats from concurrent ffmpeg processes apart
+				ffmpegCmd.Stderr = newStatsWriter(log)
+			}
+			log.Debugf("FFMPEG args: %v", ffmpegCmd.Args)
+
+			err := runFFmpeg(ctx, ffmpegCmd, log)
+			if ffmpegOutput != nil && ffmpegOutput.Len() > 0 {
+				log.Errorf("FFMPEG Error: %s", ffmpegOutput.Bytes())
+			}
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			ffmpegErr := newFFmpegError(err, ffmpegOutput)
+			if ffJob.local {
+				return ffmpegErr
+			}
+			ffmpegErr.network = true
+			return d.diagnose(ctx, job, ffJob.vidInput, ffmpegErr)
+		})
+		if err != nil {
+			break
+		}
+	}
+	removePassLogs(ffJob)
+	tracker.finish(err == nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			reportLeftovers(log, subFilePath, srcFilePath, partFilePath, resumeFilePath)
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if resumeFrom > 0 {
+		if err := d.joinParts(ctx, log, job.Format, partFilePath, resumeFilePath); err != nil {
+			if ctx.Err() != nil {
+				reportLeftovers(log, subFilePath, partFilePath, resumeFilePath)
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("Unable to join resumed download: %w", err)
+		}
+	}
+	if _, err := os.Stat(partFilePath); !os.IsNotExist(err) {
+		// rename .part file to final filename
+		err := os.Rename(partFilePath, vidFilePath)
+		if err != nil {
+			log.Debugf("Error renaming %q to %q: %v", partFilePath, vidFilePath, err)
+			return nil, errors.New("Unable to rename file")
+		}
+	}
+	stat, err := os.Stat(vidFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Video was not saved: %v", err)
+	}
+	result.Path = vidFilePath
+	result.Size = stat.Size()
+	result.FileName = job.FileName
+	result.Elapsed = time.Since(started)
+	if result.SHA256, err = fileChecksum(vidFilePath); err != nil {
+		log.Warningf("Unable to get the checksum of %v: %v", vidFilePath, err)
+	}
+	if d.Native {
+		log.Debugf("Deleting %v", srcFilePath)
+		os.Remove(srcFilePath)
+	}
+	if burnSubs || removeSubs {
+		// clear subtitle file since it's already in the video
+		log.Debugf("Deleting %v", subFilePath)
+		os.Remove(subFilePath)
+	} else if job.state.subtitles == subFilePath {
+		result.SubtitlePath = subFilePath
+	}
+	log.Infof("Saved video: %v", vidFilePath)
+	return result, nil
+}
+
+// clipEnd describes the end of a clip for messages
+func clipEnd(end time.Duration) string {
+	if end == 0 {
+		return "the end"
+	}
+	return end.String()
+}
+
+// reportLeftovers logs the files that an interrupted download left on disk
+func reportLeftovers(log Logger, paths ...string) {
+	found := false
+	for _, p := range paths {
+		if stat, err := os.Stat(p); err == nil {
+			log.Warningf("Left on disk: %v (%v bytes)", p, stat.Size())
+			found = true
+		}
+	}
+	if !found {
+		log.Warningf("Nothing was left on disk")
+	}
+}
+
+// diagnose makes a request to vidURL to find out why ffmpeg failed.
+// ffmpegErr is returned if the video can be downloaded.
+func (d *Downloader) diagnose(ctx context.Context, job Job, vidURL string, ffmpegErr error) error {
+	request, _ := http.NewRequest("GET", vidURL, nil)
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", d.userAgent())
+	response, err := d.client().Do(request)
+	if err != nil {
+		return fmt.Errorf("Error downloading video: %w", hostDown(err))
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 400 ||
+		strings.Contains(response.Header.Get("content-type"), "text/html") {
+		httpErr := newHTTPError(response)
+		d.logger(job).Debugf("Requested %v: %v", httpErr.URL, httpErr)
+		d.explainNotFound(ctx, job, httpErr)
+		return fmt.Errorf("Error downloading video: %w", httpErr)
+	}
+	return ffmpegErr
+}
+
+// explainNotFound sets the reason for a video that the host does not have.
+// The subtitles depend only on the code, so if they cannot be found either
+// the code is invalid, otherwise the resolution is not available.
+func (d *Downloader) explainNotFound(ctx context.Context, job Job, httpErr *HTTPError) {
+	if !httpErr.notFound() {
+		return
+	}
+	found := false
+	err := d.withRetries(ctx, job, "subtitles check", func() error {
+		request, _ := http.NewRequest("GET", d.SubtitleURL(job.Code), nil)
+		request = request.WithContext(ctx)
+		request.Header.Set("User-Agent", d.userAgent())
+		response, err := d.client().Do(request)
+		if err != nil {
+			return hostDown(err)
+		}
+		response.Body.Close()
+		if response.StatusCode >= 400 ||
+			strings.Contains(response.Header.Get("content-type"), "text/html") {
+			if subErr := newHTTPError(response); subErr.temporary() {
+				return subErr
+			}
+			return nil
+		}
+		found = true
+		return nil
+	})
+	if err != nil {
+		// unable to tell
+		return
+	}
+	if found {
+		httpErr.Err = ErrResolutionUnavailable
+	} else {
+		httpErr.Err = ErrInvalidCode
+	}
+}
+
+// folder returns the absolute download folder for a job, creating it and
+// any subfolders in FileName if needed
+func (d *Downloader) folder(job Job) (string, error) {
+	folder := job.Folder
+	if folder == "" {
+		folder = d.Folder
+	}
+	if folder == "" {
+		folder = "."
+	}
+	absFolderPath, err := filepath.Abs(folder)
+	if err != nil {
+		return "", err
+	}
+	subFolderPath := filepath.Join(absFolderPath, filepath.Dir(job.FileName))
+	if stat, err := os.Stat(subFolderPath); err != nil || !stat.IsDir() {
+		if err := os.MkdirAll(subFolderPath, os.ModePerm); err != nil {
+			return "", fmt.Errorf("Unable to create folder: %v", err)
+		}
+		d.logger(job).Infof("Created folder: %v", subFolderPath)
+	}
+	return absFolderPath, nil
+}
+
+func (d *Downloader) subtitleFormat() string {
+	if d.SubtitleFormat == "" {
+		return SubtitleSRT
+	}
+	return d.SubtitleFormat
+}
+
+func (d *Downloader) subtitleScale() float64 {
+	if d.SubtitleScale == 0 {
+		return 1
+	}
+	return d.SubtitleScale
+}
+
+func (d *Downloader) baseURL() string {
+	return hostURL(d.host())
+}
+
+func (d *Downloader) client() *http.Client {
+	if d.Client == nil {
+		return http.DefaultClient
+	}
+	return d.Client
+}
+
+func (d *Downloader) userAgent() string {
+	if d.UserAgent == "" {
+		return DefaultUserAgent
+	}
+	return d.UserAgent
+}
+
+func (d *Downloader) logger(job Job) Logger {
+	if job.Logger != nil {
+		return job.Logger
+	}
+	if d.Logger != nil {
+		return d.Logger
+	}
+	return nopLogger{}
+}
+
+// stringInSlice returns a bool indicating if specified string is in the list of strings
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobValidate(t *testing.T) {
+	valid := Job{Code: "abc123", FileName: "ep1", Resolution: "720p"}
+	tests := []struct {
+		name    string
+		change  func(j *Job)
+		wantErr string // part of the error, or "" if the job is valid
+	}{
+		{"valid", func(j *Job) {}, ""},
+		{"subfolder", func(j *Job) { j.FileName = "Show/S01/ep1" }, ""},
+		{"best", func(j *Job) { j.Resolution = ResolutionBest }, ""},
+		{"worst", func(j *Job) { j.Resolution = ResolutionWorst }, ""},
+		{"higher", func(j *Job) { j.Resolution = "720p+" }, ""},
+		{"rank", func(j *Job) { j.Resolution = "2" }, ""},
+		{"format", func(j *Job) { j.Format = FormatMP4 }, ""},
+		{"clip", func(j *Job) { j.ClipStart, j.ClipEnd = time.Second, 2*time.Second }, ""},
+		{"gif clip", func(j *Job) { j.Format, j.ClipEnd = FormatGIF, time.Second }, ""},
+		{"tags", func(j *Job) { j.Tags = Tags{AudioLanguage: "kor", Date: "2017-01-02"} }, ""},
+		{"no code", func(j *Job) { j.Code = "" }, "Download Code cannot be blank"},
+		{"no filename", func(j *Job) { j.FileName = "" }, "Filename cannot be blank"},
+		{"absolute filename", func(j *Job) { j.FileName = "/tmp/ep1" }, "inside the download folder"},
+		{"parent folder", func(j *Job) { j.FileName = "../ep1" }, "inside the download folder"},
+		{"hidden parent folder", func(j *Job) { j.FileName = "Show/../../ep1" }, "inside the download folder"},
+		{"no resolution", func(j *Job) { j.Resolution = "" }, "Resolution cannot be blank"},
+		{"bad resolution", func(j *Job) { j.Resolution = "720" }, "Invalid resolution"},
+		{"bad format", func(j *Job) { j.Format = "avi" }, "Invalid format"},
+		{"negative clip", func(j *Job) { j.ClipStart = -time.Second }, "Invalid clip"},
+		{"clip ends first", func(j *Job) { j.ClipStart, j.ClipEnd = 2*time.Second, time.Second }, "Invalid clip"},
+		{"gif without end", func(j *Job) { j.Format = FormatGIF }, "needs the end of the clip"},
+		{"bad language", func(j *Job) { j.Tags.SubtitleLanguage = "english" }, "Invalid language"},
+		{"bad date", func(j *Job) { j.Tags.Date = "02/01/2017" }, "Invalid date"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			j := valid
+			test.change(&j)
+			err := j.Validate()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if j.Format == "" {
+					t.Error("the default format was not filled in")
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestJobValidateDefaultFormat(t *testing.T) {
+	j := Job{Code: "abc123", FileName: "ep1", Resolution: "720p"}
+	if err := j.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if j.Format != Formats[0] {
+		t.Errorf("format %q, want %q", j.Format, Formats[0])
+	}
+}
+
+func TestDownloaderValidate(t *testing.T) {
+	job := Job{Code: "abc123", FileName: "ep1", Resolution: "720p"}
+	tests := []struct {
+		name    string
+		d       *Downloader
+		code    string
+		wantErr error
+	}{
+		{"valid", &Downloader{}, "abc123", nil},
+		{"code rejected by the provider", &Downloader{}, "abc-123", ErrInvalidCode},
+		{"provider without a code pattern", &Downloader{Provider: &TemplateProvider{}}, "abc-123", nil},
+		{"conflict policy", &Downloader{OnConflict: "ask"}, "abc123", errors.New("Invalid conflict policy: ask")},
+		{"subtitle format", &Downloader{SubtitleFormat: "sub"}, "abc123", errors.New("Invalid subtitle format: sub")},
+		{"target size without native", &Downloader{Profile: &Profile{TargetSize: "100M"}}, "abc123",
+			errors.New("A target size needs the native downloader")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			j := job
+			j.Code = test.code
+			err := test.d.Validate(&j)
+			if test.wantErr == nil {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !errors.Is(err, test.wantErr) && err.Error() != test.wantErr.Error() {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+// Logger is implemented by anything that can receive leveled log messages
+type Logger interface {
+	Debugf(msg string, a ...interface{})
+	Infof(msg string, a ...interface{})
+	Warningf(msg string, a ...interface{})
+	Errorf(msg string, a ...interface{})
+}
+
+// nopLogger discards all messages
+type nopLogger struct{}
+
+func (nopLogger) Debugf(msg string, a ...interface{})   {}
+func (nopLogger) Infof(msg string, a ...interface{})    {}
+func (nopLogger) Warningf(msg string, a ...interface{}) {}
+func (nopLogger) Errorf(msg string, a ...interface{})   {}
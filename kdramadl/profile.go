@@ -0,0 +1,232 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profile describes how the video is encoded, for example to make small
+// copies for a phone. With a Profile the video is always encoded, also
+// for mkv. Without one, video that has to be encoded uses the encoder of
+// the format, such as libx264, with ffmpeg's defaults.
+type Profile struct {
+	VideoCodec   string `yaml:"codec"`         // e.g. libx264, libx265 or libvpx-vp9, defaults to the format's encoder
+	CRF          int    `yaml:"crf"`           // Constant quality, lower is better. Unused if 0.
+	VideoBitrate string `yaml:"bitrate"`       // Video bitrate such as "2M", instead of CRF
+	Preset       string `yaml:"preset"`        // x264 preset such as "slow", see videoArgs
+	AudioCodec   string `yaml:"audio_codec"`   // e.g. aac or libopus, not for audio formats. The audio is copied if blank.
+	AudioBitrate string `yaml:"audio_bitrate"` // Audio bitrate such as "128k"
+	MaxHeight    int    `yaml:"max_height"`    // Taller video is scaled down to this height, e.g. 720
+
+	// TargetSize such as "300M" or "1.2G" makes a two-pass encode with the
+	// video bitrate that gives a file of about this size
+	TargetSize string `yaml:"target_size"`
+}
+
+// vp9CPUUsed translates the x264 presets to the -cpu-used speeds of
+// libvpx-vp9, which has no presets
+var vp9CPUUsed = map[string]string{
+	"placebo": "0", "veryslow": "0", "slower": "1", "slow": "1", "medium": "2",
+	"fast": "3", "faster": "4", "veryfast": "4", "superfast": "5", "ultrafast": "5",
+}
+
+// defaultAudioBitrate is assumed for copied audio when working out the
+// video bitrate for a TargetSize
+const defaultAudioBitrate = 128000
+
+// Check returns an error if the profile's values are invalid
+func (p *Profile) Check() error {
+	if p.CRF < 0 || p.MaxHeight < 0 {
+		return errors.New("crf and max_height cannot be negative")
+	}
+	if p.TargetSize != "" {
+		if p.VideoBitrate != "" || p.CRF != 0 {
+			return errors.New("target_size cannot be used with bitrate or crf")
+		}
+		if _, err := parseSize(p.TargetSize); err != nil {
+			return fmt.Errorf("invalid target_size: %v", err)
+		}
+	}
+	for _, bitrate := range []string{p.VideoBitrate, p.AudioBitrate} {
+		if bitrate == "" {
+			continue
+		}
+		if _, err := parseBitrate(bitrate); err != nil {
+			return fmt.Errorf("invalid bitrate %q", bitrate)
+		}
+	}
+	return nil
+}
+
+// videoArgs returns the ffmpeg options for encoding the video with the
+// profile's codec, or encoder if it has none. bitrate is the bitrate
+// worked out for TargetSize, if any. The preset is passed on to libx264
+// and libx265, translated for libvpx-vp9 and ignored for other encoders,
+// which have presets of their own or none at all.
+func (p *Profile) videoArgs(encoder string, bitrate string) []string {
+	if p == nil {
+		return []string{"-c:v", encoder}
+	}
+	codec := p.VideoCodec
+	if codec == "" {
+		codec = encoder
+	}
+	args := []string{"-c:v", codec}
+	switch {
+	case p.Preset == "":
+	case codec == "libx264" || codec == "libx265":
+		args = append(args, "-preset", p.Preset)
+	case codec == "libvpx-vp9":
+		if speed, ok := vp9CPUUsed[p.Preset]; ok {
+			args = append(args, "-deadline", "good", "-cpu-used", speed)
+		}
+	}
+	if bitrate == "" {
+		bitrate = p.VideoBitrate
+	}
+	if bitrate != "" {
+		args = append(args, "-b:v", bitrate)
+	} else if p.CRF > 0 {
+		args = append(args, "-crf", strconv.Itoa(p.CRF))
+		if codec == "libvpx-vp9" {
+			// vp9 only uses constant quality without a bitrate limit
+			args = append(args, "-b:v", "0")
+		}
+	}
+	return args
+}
+
+// audioArgs returns the ffmpeg options for encoding the audio into
+// container c, or nil if the audio is copied. The codec of audio formats
+// such as mp3 is given by the format, so only the profile's bitrate is
+// used for them, with the format's encoder.
+func (p *Profile) audioArgs(c container) []string {
+	if p == nil {
+		return nil
+	}
+	codec := p.AudioCodec
+	if c.audioOnly() {
+		codec = ""
+		if p.AudioBitrate != "" {
+			codec = c.audioEncoder
+		}
+	}
+	if codec == "" {
+		return nil
+	}
+	args := []string{"-c:a", codec}
+	if p.AudioBitrate != "" {
+		args = append(args, "-b:a", p.AudioBitrate)
+	}
+	return args
+}
+
+// scaleFilter returns the filter that scales video down to MaxHeight
+func (p *Profile) scaleFilter() string {
+	if p == nil || p.MaxHeight == 0 {
+		return ""
+	}
+	return fmt.Sprintf("scale=-2:'min(%v,ih)'", p.MaxHeight)
+}
+
+// planTargetSize sets up a two-pass encode with the video bitrate that
+// gives a file of the profile's TargetSize for the duration of the source
+func (d *Downloader) planTargetSize(ctx context.Context, log Logger, f *ffmpegJob, input string) error {
+	p := d.Profile
+	if p == nil || p.TargetSize == "" {
+		return nil
+	}
+	var duration time.Duration
+	var err error
+	if f.local {
+		duration, err = d.probeDuration(ctx, input)
+	} else {
+		duration, err = d.probeSourceDuration(ctx, input)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to get the video duration for the target size: %v", err)
+	}
+	duration = f.length(duration)
+	if duration <= 0 {
+		return errors.New("Unable to get the video duration for the target size: the duration is unknown")
+	}
+	size, _ := parseSize(p.TargetSize)
+	audioBitrate := int64(defaultAudioBitrate)
+	if p.AudioBitrate != "" {
+		audioBitrate, _ = parseBitrate(p.AudioBitrate)
+	}
+	videoBitrate := int64(float64(size*8)/duration.Seconds()) - audioBitrate
+	if videoBitrate <= 0 {
+		return fmt.Errorf("Target size %v is too small for %v of video", p.TargetSize, duration.Round(time.Second))
+	}
+	log.Infof("Encoding at %vk for a %v file", videoBitrate/1000, p.TargetSize)
+	f.videoBitrate = strconv.FormatInt(videoBitrate, 10)
+	f.passLogFile = f.output + ".passlog"
+	return nil
+}
+
+// removePassLogs deletes the statistics files of a two-pass encode
+func removePassLogs(f ffmpegJob) {
+	if f.passLogFile == "" {
+		return
+	}
+	logs, _ := filepath.Glob(f.passLogFile + "*")
+	for _, path := range logs {
+		os.Remove(path)
+	}
+}
+
+// parseSize parses a file size such as "300M" or "1.2G"
+func parseSize(s string) (int64, error) {
+	return parseUnits(strings.TrimSuffix(strings.ToUpper(s), "B"), 1024)
+}
+
+// parseBitrate parses a bitrate in bits per second such as "128k" or "2M"
+func parseBitrate(s string) (int64, error) {
+	return parseUnits(strings.ToUpper(s), 1000)
+}
+
+// parseUnits parses a number with an optional K, M or G suffix
+func parseUnits(s string, base float64) (int64, error) {
+	s = strings.TrimSpace(s)
+	multiplier := 1.0
+	for i, unit := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(s, unit) {
+			s = strings.TrimSuffix(s, unit)
+			multiplier = base
+			for j := 0; j < i; j++ {
+				multiplier *= base
+			}
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * multiplier), nil
+}
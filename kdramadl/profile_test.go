@@ -0,0 +1,79 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProfileVideoArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       *Profile
+		encoder string
+		bitrate string
+		want    []string
+	}{
+		{"no profile", nil, "libx264", "", []string{"-c:v", "libx264"}},
+		{"x264", &Profile{CRF: 23, Preset: "slow"}, "libx264", "",
+			[]string{"-c:v", "libx264", "-preset", "slow", "-crf", "23"}},
+		{"x265", &Profile{VideoCodec: "libx265", Preset: "fast", VideoBitrate: "2M"}, "libx264", "",
+			[]string{"-c:v", "libx265", "-preset", "fast", "-b:v", "2M"}},
+		{"vp9 preset", &Profile{CRF: 31, Preset: "slow"}, "libvpx-vp9", "",
+			[]string{"-c:v", "libvpx-vp9", "-deadline", "good", "-cpu-used", "1", "-crf", "31", "-b:v", "0"}},
+		{"vp9 unknown preset", &Profile{Preset: "p7"}, "libvpx-vp9", "",
+			[]string{"-c:v", "libvpx-vp9"}},
+		{"other encoder", &Profile{VideoCodec: "h264_nvenc", Preset: "slow"}, "libx264", "",
+			[]string{"-c:v", "h264_nvenc"}},
+		{"target size bitrate", &Profile{TargetSize: "300M"}, "libx264", "1500000",
+			[]string{"-c:v", "libx264", "-b:v", "1500000"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.p.videoArgs(test.encoder, test.bitrate); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProfileAudioArgs(t *testing.T) {
+	aac := &Profile{AudioCodec: "aac", AudioBitrate: "96k"}
+	tests := []struct {
+		name   string
+		p      *Profile
+		format string
+		want   []string
+	}{
+		{"no profile", nil, FormatMP4, nil},
+		{"copied", &Profile{CRF: 23}, FormatMP4, nil},
+		{"encoded", aac, FormatMKV, []string{"-c:a", "aac", "-b:a", "96k"}},
+		{"mp3 keeps its codec", aac, FormatMP3, []string{"-c:a", "libmp3lame", "-b:a", "96k"}},
+		{"opus keeps its codec", aac, FormatOpus, []string{"-c:a", "libopus", "-b:a", "96k"}},
+		{"audio format without bitrate", &Profile{AudioCodec: "libopus"}, FormatM4A, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.p.audioArgs(containers[test.format]); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress stages
+const (
+	StageDownload = "download" // fetching the video with Native
+	StageFFmpeg   = "ffmpeg"   // ffmpeg downloading and/or muxing the video
+)
+
+// Progress describes how far a download has got
+type Progress struct {
+	Stage    string
+	Bytes    int64         // Bytes downloaded or written so far
+	Total    int64         // Expected number of bytes, 0 if unknown
+	Position time.Duration // Media time processed by ffmpeg
+	Duration time.Duration // Media duration, 0 if unknown
+	Rate     float64       // Current speed in bytes per second
+	Elapsed  time.Duration
+	Done     bool // Set on the last report of a stage
+}
+
+// Fraction returns how much has been done from 0 to 1, or -1 if unknown
+func (p Progress) Fraction() float64 {
+	var fraction float64
+	switch {
+	case p.Total > 0:
+		fraction = float64(p.Bytes) / float64(p.Total)
+	case p.Duration > 0:
+		fraction = float64(p.Position) / float64(p.Duration)
+	default:
+		return -1
+	}
+	if fraction > 1 {
+		return 1
+	}
+	return fraction
+}
+
+// ETA returns the estimated time left, or -1 if unknown
+func (p Progress) ETA() time.Duration {
+	fraction := p.Fraction()
+	if fraction <= 0 {
+		return -1
+	}
+	return time.Duration(float64(p.Elapsed) * (1 - fraction) / fraction)
+}
+
+// progressInterval is how often progress is reported
+var progressInterval = 500 * time.Millisecond
+
+// progressTracker collects progress for one stage of a job and reports it
+// to Downloader.OnProgress at regular intervals. A nil tracker ignores all
+// updates, so callers need not check whether progress is wanted.
+type progressTracker struct {
+	bytes    int64 // atomic
+	total    int64 // atomic
+	position int64 // atomic, in time.Duration units
+
+	report   func(Progress)
+	stage    string
+	duration time.Duration
+	started  time.Time
+
+	mu        sync.Mutex
+	lastBytes int64
+	lastTime  time.Time
+	rate      float64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startProgress starts reporting progress of a stage, or returns nil if
+// nobody is listening
+func (d *Downloader) startProgress(job Job, stage string, duration time.Duration) *progressTracker {
+	if d.OnProgress == nil {
+		return nil
+	}
+	t := &progressTracker{
+		report:   func(p Progress) { d.OnProgress(job, p) },
+		stage:    stage,
+		duration: duration,
+		started:  time.Now(),
+		lastTime: time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.report(t.progress(false))
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// finish stops the tracker. If completed, a final report is made.
+func (t *progressTracker) finish(completed bool) {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	if completed {
+		t.report(t.progress(true))
+	}
+}
+
+func (t *progressTracker) progress(done bool) Progress {
+	p := Progress{
+		Stage:    t.stage,
+		Bytes:    atomic.LoadInt64(&t.bytes),
+		Total:    atomic.LoadInt64(&t.total),
+		Position: time.Duration(atomic.LoadInt64(&t.position)),
+		Duration: t.duration,
+		Elapsed:  time.Since(t.started),
+		Done:     done,
+	}
+	if done && p.Total > 0 {
+		p.Bytes = p.Total
+	}
+	if done && p.Duration > 0 {
+		p.Position = p.Duration
+	}
+
+	// smooth the rate so that it does not jump around between reports
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elapsed := time.Since(t.lastTime).Seconds(); elapsed > 0 {
+		rate := float64(p.Bytes-t.lastBytes) / elapsed
+		if rate < 0 {
+			rate = 0
+		}
+		if t.rate == 0 {
+			t.rate = rate
+		} else {
+			t.rate = 0.7*t.rate + 0.3*rate
+		}
+		t.lastBytes = p.Bytes
+		t.lastTime = time.Now()
+	}
+	p.Rate = t.rate
+	return p
+}
+
+func (t *progressTracker) setTotal(total int64) {
+	if t != nil {
+		atomic.StoreInt64(&t.total, total)
+	}
+}
+
+func (t *progressTracker) setBytes(n int64) {
+	if t != nil {
+		atomic.StoreInt64(&t.bytes, n)
+	}
+}
+
+func (t *progressTracker) addBytes(n int64) {
+	if t != nil {
+		atomic.AddInt64(&t.bytes, n)
+	}
+}
+
+func (t *progressTracker) setPosition(position time.Duration) {
+	if t != nil {
+		atomic.StoreInt64(&t.position, int64(position))
+	}
+}
+
+// countingWriter passes writes through and counts the bytes
+type countingWriter struct {
+	w       io.Writer
+	tracker *progressTracker
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.tracker.addBytes(int64(n))
+	return n, err
+}
+
+// ffmpegProgressWriter parses the key=value lines that ffmpeg writes with
+// "-progress pipe:1" and updates the tracker
+type ffmpegProgressWriter struct {
+	tracker *progressTracker
+	line    []byte
+}
+
+func (w *ffmpegProgressWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b != '\n' {
+			w.line = append(w.line, b)
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(string(w.line)), "=", 2)
+		w.line = w.line[:0]
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "total_size":
+			if size, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+				w.tracker.setBytes(size)
+			}
+		case "out_time_us", "out_time_ms":
+			// both are in microseconds
+			if us, err := strconv.ParseInt(parts[1], 10, 64); err == nil && us > 0 {
+				w.tracker.setPosition(time.Duration(us) * time.Microsecond)
+			}
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Provider builds the download URLs of a source. A URL may be relative,
+// such as "?dcode=abc", in which case it is resolved against the host in
+// use so that Downloader.Hosts and failover apply.
+type Provider interface {
+	// SubtitleURL returns the subtitle download URL for a code
+	SubtitleURL(code string) string
+	// VideoURL returns the video download URL for a code and quality
+	VideoURL(code string, quality string) string
+	// ListQualities returns the qualities a video may be available in,
+	// best first. Not every video is available in all of them.
+	ListQualities(code string) ([]string, error)
+	// Validate returns an error wrapping ErrInvalidCode if the code
+	// cannot be valid
+	Validate(code string) error
+}
+
+// TemplateProvider is a Provider defined by URL templates, in which
+// {code} and {quality} are replaced with the query escaped values
+type TemplateProvider struct {
+	Subtitles string   `yaml:"subtitles"` // Subtitle URL template
+	Video     string   `yaml:"video"`     // Video URL template
+	Qualities []string `yaml:"qualities"` // Qualities offered, best first
+	Code      string   `yaml:"code"`      // Regular expression that valid codes match
+}
+
+// GoPlay is the built-in provider for HostMain and HostAlt
+var GoPlay Provider = &TemplateProvider{
+	Subtitles: "?dcode={code}&downloadccsub=1",
+	Video:     "?dcode={code}&quality={quality}&downloadmp4vid=1",
+	Qualities: []string{"1080p", "720p", "480p", "360p"},
+	Code:      "^[a-zA-Z0-9]+$",
+}
+
+// Check returns an error if the templates are incomplete or invalid
+func (p *TemplateProvider) Check() error {
+	if p.Subtitles == "" || p.Video == "" {
+		return errors.New("subtitles and video templates are required")
+	}
+	if !strings.Contains(p.Video, "{quality}") {
+		return errors.New("video template has no {quality}")
+	}
+	for _, template := range []string{p.Subtitles, p.Video} {
+		if !strings.Contains(template, "{code}") {
+			return fmt.Errorf("template %q has no {code}", template)
+		}
+	}
+	if _, err := regexp.Compile(p.Code); err != nil {
+		return fmt.Errorf("invalid code pattern: %v", err)
+	}
+	return nil
+}
+
+// SubtitleURL fills in the subtitle template
+func (p *TemplateProvider) SubtitleURL(code string) string {
+	return strings.NewReplacer("{code}", url.QueryEscape(code)).Replace(p.Subtitles)
+}
+
+// VideoURL fills in the video template
+func (p *TemplateProvider) VideoURL(code string, quality string) string {
+	return strings.NewReplacer(
+		"{code}", url.QueryEscape(code), "{quality}", url.QueryEscape(quality)).Replace(p.Video)
+}
+
+// ListQualities returns the qualities from the provider definition
+func (p *TemplateProvider) ListQualities(code string) ([]string, error) {
+	if len(p.Qualities) == 0 {
+		return nil, errors.New("No qualities are listed for this provider")
+	}
+	return append([]string{}, p.Qualities...), nil
+}
+
+// Validate checks the code against the code pattern, if there is one
+func (p *TemplateProvider) Validate(code string) error {
+	if p.Code == "" {
+		return nil
+	}
+	codeRegex, err := regexp.Compile(p.Code)
+	if err != nil {
+		return err
+	}
+	if !codeRegex.MatchString(code) {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (d *Downloader) provider() Provider {
+	if d.Provider == nil {
+		return GoPlay
+	}
+	return d.Provider
+}
+
+// resolve makes a URL from the provider absolute using the host in use
+func (d *Downloader) resolve(ref string) string {
+	refURL, err := url.Parse(ref)
+	if err != nil || refURL.IsAbs() {
+		return ref
+	}
+	baseURL, err := url.Parse(d.baseURL())
+	if err != nil {
+		return ref
+	}
+	return baseURL.ResolveReference(refURL).String()
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTemplateProviderURLs(t *testing.T) {
+	p := &TemplateProvider{
+		Subtitles: "https://example.com/subs/{code}.srt",
+		Video:     "https://example.com/video?id={code}&q={quality}",
+	}
+	tests := []struct {
+		code, quality      string
+		wantSub, wantVideo string
+	}{
+		{"abc123", "720p", "https://example.com/subs/abc123.srt", "https://example.com/video?id=abc123&q=720p"},
+		{"a b&c", "1080p+", "https://example.com/subs/a+b%26c.srt", "https://example.com/video?id=a+b%26c&q=1080p%2B"},
+	}
+	for _, test := range tests {
+		if got := p.SubtitleURL(test.code); got != test.wantSub {
+			t.Errorf("SubtitleURL(%q) = %q, want %q", test.code, got, test.wantSub)
+		}
+		if got := p.VideoURL(test.code, test.quality); got != test.wantVideo {
+			t.Errorf("VideoURL(%q, %q) = %q, want %q", test.code, test.quality, got, test.wantVideo)
+		}
+	}
+}
+
+func TestDownloaderURLs(t *testing.T) {
+	relative := &TemplateProvider{Subtitles: "subs/{code}.srt", Video: "videos/{code}-{quality}.mp4"}
+	absolute := &TemplateProvider{Subtitles: "https://cdn.example.com/{code}.srt", Video: "https://cdn.example.com/{code}/{quality}.mp4"}
+	tests := []struct {
+		name               string
+		d                  *Downloader
+		wantSub, wantVideo string
+	}{
+		{
+			name:      "GoPlay on the default host",
+			d:         &Downloader{},
+			wantSub:   "https://goplay.anontpp.com/?dcode=abc&downloadccsub=1",
+			wantVideo: "https://goplay.anontpp.com/?dcode=abc&quality=720p&downloadmp4vid=1",
+		},
+		{
+			name:      "GoPlay on another host",
+			d:         &Downloader{Hosts: []string{HostAlt}},
+			wantSub:   "https://kdrama.armsasuncion.com/?dcode=abc&downloadccsub=1",
+			wantVideo: "https://kdrama.armsasuncion.com/?dcode=abc&quality=720p&downloadmp4vid=1",
+		},
+		{
+			name:      "relative templates on a host with a path",
+			d:         &Downloader{Hosts: []string{"http://127.0.0.1:8080/mirror"}, Provider: relative},
+			wantSub:   "http://127.0.0.1:8080/mirror/subs/abc.srt",
+			wantVideo: "http://127.0.0.1:8080/mirror/videos/abc-720p.mp4",
+		},
+		{
+			name:      "absolute templates ignore the host",
+			d:         &Downloader{Provider: absolute},
+			wantSub:   "https://cdn.example.com/abc.srt",
+			wantVideo: "https://cdn.example.com/abc/720p.mp4",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.d.SubtitleURL("abc"); got != test.wantSub {
+				t.Errorf("SubtitleURL = %q, want %q", got, test.wantSub)
+			}
+			if got := test.d.VideoURL("abc", "720p"); got != test.wantVideo {
+				t.Errorf("VideoURL = %q, want %q", got, test.wantVideo)
+			}
+		})
+	}
+}
+
+func TestCurrentURLFollowsFailover(t *testing.T) {
+	d := &Downloader{}
+	subURL := d.SubtitleURL("abc")
+	if !d.failover(Job{}, HostMain, ErrHostDown) {
+		t.Fatal("no failover to the second host")
+	}
+	if got, want := d.currentURL(subURL), "https://kdrama.armsasuncion.com/?dcode=abc&downloadccsub=1"; got != want {
+		t.Errorf("currentURL = %q, want %q", got, want)
+	}
+}
+
+func TestTemplateProviderCheck(t *testing.T) {
+	tests := []struct {
+		p     TemplateProvider
+		valid bool
+	}{
+		{TemplateProvider{Subtitles: "s/{code}", Video: "v/{code}/{quality}", Code: "^[a-z]+$"}, true},
+		{TemplateProvider{Subtitles: "s/{code}", Video: "v/{code}/{quality}"}, true},
+		{TemplateProvider{Video: "v/{code}/{quality}"}, false},
+		{TemplateProvider{Subtitles: "s/{code}", Video: "v/{code}"}, false},
+		{TemplateProvider{Subtitles: "s/", Video: "v/{code}/{quality}"}, false},
+		{TemplateProvider{Subtitles: "s/{code}", Video: "v/{code}/{quality}", Code: "(["}, false},
+	}
+	for _, test := range tests {
+		if err := test.p.Check(); (err == nil) != test.valid {
+			t.Errorf("%+v: got error %v, want valid %v", test.p, err, test.valid)
+		}
+	}
+}
+
+func TestTemplateProviderValidate(t *testing.T) {
+	for code, valid := range map[string]bool{"abc123": true, "ABC": true, "": false, "abc-123": false, "a b": false} {
+		err := GoPlay.Validate(code)
+		if valid && err != nil {
+			t.Errorf("%q: unexpected error %v", code, err)
+		} else if !valid && !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("%q: got error %v, want %v", code, err, ErrInvalidCode)
+		}
+	}
+}
+
+func TestTemplateProviderListQualities(t *testing.T) {
+	p := &TemplateProvider{Qualities: []string{"1080p", "720p"}}
+	qualities, err := p.ListQualities("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qualities[0] = "360p"
+	if want := []string{"1080p", "720p"}; !reflect.DeepEqual(p.Qualities, want) {
+		t.Errorf("changing the list changed the provider: %v", p.Qualities)
+	}
+	if _, err := (&TemplateProvider{}).ListQualities("abc"); err == nil {
+		t.Error("no error for a provider without qualities")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Resolutions that are picked from the qualities available
+const (
+	ResolutionBest  = "best"
+	ResolutionWorst = "worst"
+)
+
+// Quality describes whether a video is available in a resolution
+type Quality struct {
+	Resolution string
+	Available  bool
+	Size       int64         // Content length, -1 if unknown
+	Duration   time.Duration // 0 if unknown or ffprobe is not installed
+}
+
+// ListQualities checks each quality of the provider against the host and
+// returns them best first
+func (d *Downloader) ListQualities(ctx context.Context, job Job) ([]Quality, error) {
+	if err := d.provider().Validate(job.Code); err != nil {
+		return nil, err
+	}
+	resolutions, err := d.provider().ListQualities(job.Code)
+	if err != nil {
+		return nil, err
+	}
+	var qualities []Quality
+	for _, resolution := range resolutions {
+		q, err := d.checkQuality(ctx, job, resolution)
+		if err != nil {
+			return nil, err
+		}
+		if q.Available {
+			duration, err := d.probeSourceDuration(ctx, d.currentURL(d.VideoURL(job.Code, resolution)))
+			if err != nil {
+				d.logger(job).Debugf("Unable to get the duration of %v: %v", resolution, err)
+			}
+			q.Duration = duration
+		}
+		qualities = append(qualities, q)
+	}
+	return qualities, nil
+}
+
+// PickResolution replaces ResolutionBest or ResolutionWorst in the job
+// with the best or worst resolution available. Other resolutions are
+// left as they are.
+func (d *Downloader) PickResolution(ctx context.Context, job *Job) error {
+	if job.Resolution != ResolutionBest && job.Resolution != ResolutionWorst {
+		return nil
+	}
+	resolutions, err := d.provider().ListQualities(job.Code)
+	if err != nil {
+		return err
+	}
+	// a Provider may return its own list, so it is not reversed in place
+	order := make([]string, len(resolutions))
+	for i, resolution := range resolutions {
+		if job.Resolution == ResolutionWorst {
+			i = len(resolutions) - 1 - i
+		}
+		order[i] = resolution
+	}
+	for _, resolution := range order {
+		q, err := d.checkQuality(ctx, *job, resolution)
+		if err != nil {
+			return err
+		}
+		if q.Available {
+			d.logger(*job).Infof("Using the %v resolution: %v", job.Resolution, resolution)
+			job.Resolution = resolution
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: none of %v", ErrResolutionUnavailable, strings.Join(resolutions, ", "))
+}
+
+// checkQuality requests the first byte of the video in a resolution
+func (d *Downloader) checkQuality(ctx context.Context, job Job, resolution string) (Quality, error) {
+	q := Quality{Resolution: resolution, Size: -1}
+	vidURL := d.VideoURL(job.Code, resolution)
+	err := d.withRetries(ctx, job, "quality check", func() error {
+		request, _ := http.NewRequest("GET", d.currentURL(vidURL), nil)
+		request = request.WithContext(ctx)
+		request.Header.Set("User-Agent", d.userAgent())
+		request.Header.Set("Range", "bytes=0-0")
+		response, err := d.client().Do(request)
+		if err != nil {
+			return hostDown(err)
+		}
+		response.Body.Close()
+		if response.StatusCode >= 400 ||
+			strings.Contains(response.Header.Get("content-type"), "text/html") {
+			if httpErr := newHTTPError(response); httpErr.temporary() {
+				return httpErr
+			}
+			// not available, which is not a reason to fail over
+			return nil
+		}
+		q.Available = true
+		if _, size, ok := parseContentRange(response.Header.Get("Content-Range")); ok {
+			q.Size = size
+		} else if response.StatusCode == http.StatusOK {
+			q.Size = response.ContentLength
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() != nil {
+		return q, ctx.Err()
+	}
+	return q, err
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// sharedProvider returns the same qualities slice on every call, as a
+// Provider with a fixed list might
+type sharedProvider struct {
+	TemplateProvider
+	qualities []string
+}
+
+func (p *sharedProvider) ListQualities(code string) ([]string, error) {
+	return p.qualities, nil
+}
+
+func TestPickResolution(t *testing.T) {
+	available := map[string]bool{"/abc/720p": true, "/abc/480p": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available[r.URL.Path] {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-0/1000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte{0})
+	}))
+	defer server.Close()
+
+	p := &sharedProvider{
+		TemplateProvider: TemplateProvider{Subtitles: "{code}.srt", Video: "{code}/{quality}"},
+		qualities:        []string{"1080p", "720p", "480p", "360p"},
+	}
+	d := &Downloader{Hosts: []string{server.URL}, Provider: p}
+	tests := []struct{ resolution, want string }{
+		{ResolutionBest, "720p"},
+		{ResolutionWorst, "480p"},
+		{ResolutionWorst, "480p"},
+		{ResolutionBest, "720p"},
+		{"1080p", "1080p"},
+	}
+	for _, test := range tests {
+		job := Job{Code: "abc", Resolution: test.resolution}
+		if err := d.PickResolution(context.Background(), &job); err != nil {
+			t.Fatalf("%v: %v", test.resolution, err)
+		}
+		if job.Resolution != test.want {
+			t.Errorf("%v: picked %v, want %v", test.resolution, job.Resolution, test.want)
+		}
+	}
+	if want := []string{"1080p", "720p", "480p", "360p"}; !reflect.DeepEqual(p.qualities, want) {
+		t.Errorf("the provider's qualities were changed to %v", p.qualities)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// resumePosition returns how much of the video is already in partFilePath.
+// A piece left behind by an interrupted resume is joined onto the part file
+// first. It returns 0 when the download has to start over, e.g. because the
+// part file was not closed properly and cannot be read.
+func (d *Downloader) resumePosition(
+	ctx context.Context, log Logger, format string,
+	partFilePath string, resumeFilePath string) time.Duration {
+
+	if _, err := os.Stat(partFilePath); err != nil {
+		os.Remove(resumeFilePath)
+		return 0
+	}
+	if _, err := os.Stat(resumeFilePath); err == nil {
+		log.Infof("Joining %v onto %v", resumeFilePath, partFilePath)
+		if err := d.joinParts(ctx, log, format, partFilePath, resumeFilePath); err != nil {
+			log.Warningf("Unable to join %v: %v", resumeFilePath, err)
+			os.Remove(resumeFilePath)
+		}
+	}
+	duration, err := d.probeDuration(ctx, partFilePath)
+	if err != nil {
+		log.Warningf("Unable to resume %v, starting over: %v", partFilePath, err)
+		return 0
+	}
+	if duration < time.Second {
+		return 0
+	}
+	return duration
+}
+
+// joinParts appends resumeFilePath onto partFilePath without re-encoding.
+// resumeFilePath was seeked from the source with its timestamps kept, so it
+// overlaps the end of partFilePath by up to a keyframe interval. The part
+// file is cut where the resumed piece starts.
+func (d *Downloader) joinParts(
+	ctx context.Context, log Logger, format string,
+	partFilePath string, resumeFilePath string) error {
+
+	start, err := d.probeStartTime(ctx, resumeFilePath)
+	if err != nil {
+		return err
+	}
+	listFilePath := partFilePath + ".txt"
+	list := fmt.Sprintf("file %v\noutpoint %v\nfile %v\n",
+		concatQuote(partFilePath), formatSeconds(start), concatQuote(resumeFilePath))
+	if err := ioutil.WriteFile(listFilePath, []byte(list), 0666); err != nil {
+		return err
+	}
+	defer os.Remove(listFilePath)
+
+	joinedFilePath := partFilePath + ".joined"
+	cmd := exec.Command(d.ffmpegPath(),
+		"-loglevel", "error", "-y", "-f", "concat", "-safe", "0", "-i", listFilePath,
+		"-map", "0", "-c", "copy", "-f", muxer(format), joinedFilePath)
+	var ffmpegOutput bytes.Buffer
+	cmd.Stderr = &ffmpegOutput
+	log.Debugf("FFMPEG args: %v", cmd.Args)
+	if err := runFFmpeg(ctx, cmd, log); err != nil {
+		os.Remove(joinedFilePath)
+		return newFFmpegError(err, &ffmpegOutput)
+	}
+	if err := os.Rename(joinedFilePath, partFilePath); err != nil {
+		return err
+	}
+	return os.Remove(resumeFilePath)
+}
+
+// concatQuote quotes a path for an ffmpeg concat list
+func concatQuote(path string) string {
+	return "'" + strings.Replace(path, "'", `'\''`, -1) + "'"
+}
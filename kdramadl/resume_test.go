@@ -0,0 +1,109 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumePosition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// ffmpeg keeps the concat list it is given and writes its output
+	ffmpeg := writeScript(t, dir, "ffmpeg", `while [ $# -gt 1 ]; do
+	[ "$1" = -i ] && cp "$2" "$(dirname "$0")/list.txt"
+	shift
+done
+echo joined > "$1"
+`)
+	ffprobe := writeScript(t, dir, "ffprobe", `case "$*" in
+*start_time*) echo 61.250000 ;;
+*) echo 123.500000 ;;
+esac
+`)
+	if err := os.Mkdir(filepath.Join(dir, "short"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	partFilePath := filepath.Join(dir, "it's.mp4.part")
+	resumeFilePath := partFilePath + ".resume"
+	tests := []struct {
+		name       string
+		ffprobe    string
+		part       bool
+		resume     bool
+		want       time.Duration
+		wantPart   string // contents of the part file afterwards
+		wantList   string // concat list given to ffmpeg
+		wantResume bool   // whether the resume file is left
+	}{
+		{"no part file", ffprobe, false, true, 0, "", "", false},
+		{"part file", ffprobe, true, false, 123500 * time.Millisecond, "part", "", false},
+		{"joins the resumed piece", ffprobe, true, true, 123500 * time.Millisecond, "joined\n",
+			"file '" + dir + "/it'\\''s.mp4.part'\noutpoint 61.250\nfile '" + dir + "/it'\\''s.mp4.part.resume'\n", false},
+		{"part file cannot be probed", filepath.Join(dir, "missing"), true, false, 0, "part", "", false},
+		{"piece cannot be probed", filepath.Join(dir, "missing"), true, true, 0, "part", "", false},
+		{"under a second", fakeFfprobe(t, filepath.Join(dir, "short"), "0.400000"), true, false, 0, "part", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(partFilePath)
+			os.Remove(resumeFilePath)
+			os.Remove(filepath.Join(dir, "list.txt"))
+			if test.part {
+				if err := ioutil.WriteFile(partFilePath, []byte("part"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.resume {
+				if err := ioutil.WriteFile(resumeFilePath, []byte("resume"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d := &Downloader{FFmpegPath: ffmpeg, FFprobePath: test.ffprobe}
+			got := d.resumePosition(context.Background(), nopLogger{}, FormatMP4, partFilePath, resumeFilePath)
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			part, _ := ioutil.ReadFile(partFilePath)
+			if string(part) != test.wantPart {
+				t.Errorf("part file holds %q, want %q", part, test.wantPart)
+			}
+			list, _ := ioutil.ReadFile(filepath.Join(dir, "list.txt"))
+			if string(list) != test.wantList {
+				t.Errorf("concat list\n%s\nwant\n%s", list, test.wantList)
+			}
+			if _, err := os.Stat(resumeFilePath); (err == nil) != test.wantResume {
+				t.Errorf("resume file left: %v, want %v", err == nil, test.wantResume)
+			}
+			if _, err := os.Stat(partFilePath + ".txt"); err == nil {
+				t.Error("concat list was not removed")
+			}
+		})
+	}
+}
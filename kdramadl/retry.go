@@ -0,0 +1,141 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Retry describes a failed attempt that is about to be retried
+type Retry struct {
+	Attempt int           // Number of the retry, starting at 1
+	Retries int           // Maximum number of retries
+	Delay   time.Duration // Wait before the retry
+	Err     error         // Error of the failed attempt
+}
+
+// Retry delay defaults
+const (
+	DefaultRetryBackoff  = time.Second
+	DefaultRetryMaxDelay = 30 * time.Second
+)
+
+// jitterRand is the random source for the retry jitter.
+// rand.Rand is not safe for concurrent use so it is guarded by jitterMutex.
+var (
+	jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMutex sync.Mutex
+)
+
+// retryDelay returns how long to wait before a retry, starting at 1.
+// The delay starts at d.RetryBackoff and doubles with each retry up to
+// d.RetryMaxDelay, then d.RetryJitter of it is added or taken away at random.
+func (d *Downloader) retryDelay(retry int) time.Duration {
+	backoff := d.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	maxDelay := d.RetryMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryMaxDelay
+	}
+	delay := backoff
+	for i := 1; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if d.RetryJitter > 0 {
+		jitterMutex.Lock()
+		r := jitterRand.Float64()
+		jitterMutex.Unlock()
+		delay = time.Duration(float64(delay) * (1 + d.RetryJitter*(2*r-1)))
+	}
+	return delay
+}
+
+// permanent reports whether retrying err is pointless: the host does not
+// have what was asked for, ffmpeg cannot read a local file, or a local
+// file cannot be written. Timeouts, connection errors and server errors
+// are worth retrying. A failed local ffmpeg run is retried only until
+// its error output has been captured.
+func permanent(err error) bool {
+	if errors.Is(err, ErrInvalidCode) || errors.Is(err, ErrResolutionUnavailable) {
+		return true
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return !httpErr.temporary()
+	}
+	var ffmpegErr *FFmpegError
+	if errors.As(err, &ffmpegErr) {
+		return !ffmpegErr.network && ffmpegErr.captured
+	}
+	var pathErr *os.PathError
+	return errors.As(err, &pathErr)
+}
+
+// withRetries calls fn until it succeeds, fails permanently, or has been
+// retried d.Retries times. what describes fn for the log.
+// If the host fails, fn is first tried again straight away on each of the
+// other hosts. fn must use d.currentURL for its requests.
+func (d *Downloader) withRetries(ctx context.Context, job Job, what string, fn func() error) error {
+	log := d.logger(job)
+	failovers := 0
+	for retry := 0; ; retry++ {
+		host := d.host()
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if failovers < len(d.hosts())-1 && hostFailed(err) && d.failover(job, host, err) {
+			failovers++
+			retry--
+			continue
+		}
+		if permanent(err) || retry >= d.Retries {
+			return err
+		}
+		delay := d.retryDelay(retry + 1)
+		log.Warningf("Retrying %v (%v/%v) in %v due to: %v",
+			what, retry+1, d.Retries, delay.Round(100*time.Millisecond), err)
+		d.retrying(job, Retry{Attempt: retry + 1, Retries: d.Retries, Delay: delay, Err: err})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retrying reports a retry to d.OnRetry if it is set
+func (d *Downloader) retrying(job Job, r Retry) {
+	if d.OnRetry != nil {
+		d.OnRetry(job, r)
+	}
+}
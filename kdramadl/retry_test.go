@@ -0,0 +1,200 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	d := &Downloader{RetryBackoff: time.Second, RetryMaxDelay: 30 * time.Second}
+	for retry, want := range map[int]time.Duration{
+		1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 5: 16 * time.Second,
+		6: 30 * time.Second, 100: 30 * time.Second,
+	} {
+		if got := d.retryDelay(retry); got != want {
+			t.Errorf("retry %v: got %v, want %v", retry, got, want)
+		}
+	}
+
+	d = &Downloader{}
+	if got := d.retryDelay(1); got != DefaultRetryBackoff {
+		t.Errorf("got %v by default, want %v", got, DefaultRetryBackoff)
+	}
+	if got := d.retryDelay(100); got != DefaultRetryMaxDelay {
+		t.Errorf("got %v at most by default, want %v", got, DefaultRetryMaxDelay)
+	}
+
+	d = &Downloader{RetryBackoff: time.Second, RetryMaxDelay: 30 * time.Second, RetryJitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := d.retryDelay(3); got < 2*time.Second || got > 6*time.Second {
+			t.Fatalf("got %v with jitter, want 2s to 6s", got)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&HTTPError{StatusCode: 404}, true},
+		{&HTTPError{StatusCode: 404, Err: ErrInvalidCode}, true},
+		{&HTTPError{StatusCode: 200, ContentType: "text/html"}, true},
+		{fmt.Errorf("checking the code: %w", ErrInvalidCode), true},
+		{fmt.Errorf("%w: none of 1080p", ErrResolutionUnavailable), true},
+		{&os.PathError{Op: "open", Path: "ep1.srt", Err: os.ErrPermission}, true},
+		{&FFmpegError{ExitCode: 1, captured: true}, true},
+		{&HTTPError{StatusCode: 500, Err: ErrHostDown}, false},
+		{&HTTPError{StatusCode: 429, Err: ErrRateLimited}, false},
+		{&HTTPError{StatusCode: 408}, false},
+		{hostDown(errors.New("connection refused")), false},
+		{&FFmpegError{ExitCode: 1, network: true, captured: true}, false},
+		{&FFmpegError{ExitCode: 1}, false},
+		{errors.New("unexpected EOF"), false},
+	}
+	for _, test := range tests {
+		if got := permanent(test.err); got != test.want {
+			t.Errorf("permanent(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	temporary := &HTTPError{StatusCode: 503, Err: ErrHostDown}
+	tests := []struct {
+		name      string
+		retries   int
+		errs      []error // returned by each call, then nil
+		wantCalls int
+		wantErr   error
+	}{
+		{"succeeds", 2, nil, 1, nil},
+		{"succeeds after retries", 2, []error{temporary, temporary}, 3, nil},
+		{"gives up", 2, []error{temporary, temporary, temporary, temporary}, 3, temporary},
+		{"no retries", 0, []error{temporary}, 1, temporary},
+		{"not found", 2, []error{&HTTPError{StatusCode: 404, Err: ErrInvalidCode}}, 1, ErrInvalidCode},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := testDownloader(1)
+			d.Retries = test.retries
+			d.Hosts = []string{"a"}
+			var attempts []int
+			d.OnRetry = func(job Job, r Retry) {
+				attempts = append(attempts, r.Attempt)
+				if r.Retries != test.retries || r.Err == nil {
+					t.Errorf("got %+v", r)
+				}
+			}
+			calls := 0
+			err := d.withRetries(context.Background(), Job{}, "test", func() error {
+				calls++
+				if calls <= len(test.errs) {
+					return test.errs[calls-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+			if calls != test.wantCalls {
+				t.Errorf("called %v times, want %v", calls, test.wantCalls)
+			}
+			if len(attempts) != calls-1 {
+				t.Errorf("reported retries %v for %v calls", attempts, calls)
+			}
+		})
+	}
+}
+
+func TestWithRetriesCancelled(t *testing.T) {
+	d := testDownloader(1)
+	d.RetryBackoff, d.RetryMaxDelay = time.Hour, time.Hour
+	d.Hosts = []string{"a"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancelled while running
+	calls := 0
+	err := d.withRetries(ctx, Job{}, "test", func() error {
+		calls++
+		cancel()
+		return hostDown(errors.New("connection reset"))
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("got %v after %v calls, want %v after 1", err, calls, context.Canceled)
+	}
+
+	// cancelled while waiting to retry
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	d.OnRetry = func(Job, Retry) { cancel() }
+	calls = 0
+	err = d.withRetries(ctx, Job{}, "test", func() error {
+		calls++
+		return hostDown(errors.New("connection reset"))
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("got %v after %v calls, want %v after 1", err, calls, context.Canceled)
+	}
+}
+
+func TestWithRetriesFailover(t *testing.T) {
+	down := hostDown(errors.New("connection refused"))
+	tests := []struct {
+		name      string
+		up        string // host that works, if any
+		wantHosts []string
+		wantErr   error
+	}{
+		{"first host", "a", []string{"a"}, nil},
+		{"third host", "c", []string{"a", "b", "c"}, nil},
+		// after trying each host once, the last one is retried
+		{"all down", "", []string{"a", "b", "c", "c"}, ErrHostDown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := testDownloader(1)
+			d.Retries = 1
+			d.Hosts = []string{"a", "b", "c"}
+			var hosts []string
+			err := d.withRetries(context.Background(), Job{}, "test", func() error {
+				host := d.host()
+				hosts = append(hosts, host)
+				if host == test.up {
+					return nil
+				}
+				return down
+			})
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(hosts, test.wantHosts) {
+				t.Errorf("tried %v, want %v", hosts, test.wantHosts)
+			}
+		})
+	}
+}
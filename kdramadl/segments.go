@@ -0,0 +1,289 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// segmentsExt is appended to a file name for the state of its segmented download
+const segmentsExt = ".segments"
+
+// minSegmentSize keeps small files from being split into tiny ranges
+const minSegmentSize = 1 << 20
+
+// segment is a byte range of a segmented download
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`  // inclusive
+	Done  int64 `json:"done"` // bytes received so far, updated atomically
+}
+
+func (s *segment) length() int64 {
+	return s.End - s.Start + 1
+}
+
+// segments is the state of a segmented download. It is saved next to the
+// file while the download is incomplete so that it can be resumed.
+type segments struct {
+	Size     int64      `json:"size"`
+	Segments []*segment `json:"segments"`
+}
+
+// newSegments splits size bytes into at most n segments
+func newSegments(size int64, n int) *segments {
+	if max := int(size / minSegmentSize); n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	state := &segments{Size: size}
+	length := size / int64(n)
+	for i := 0; i < n; i++ {
+		seg := &segment{Start: int64(i) * length, End: int64(i+1)*length - 1}
+		if i == n-1 {
+			seg.End = size - 1
+		}
+		state.Segments = append(state.Segments, seg)
+	}
+	return state
+}
+
+// loadSegments reads the saved state of a segmented download
+func loadSegments(statePath string) (*segments, error) {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	var state segments
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if len(state.Segments) == 0 {
+		return nil, fmt.Errorf("No segments in %v", statePath)
+	}
+	return &state, nil
+}
+
+// save writes the state of a segmented download to statePath
+func (state *segments) save(statePath string) error {
+	snapshot := segments{Size: state.Size}
+	for _, seg := range state.Segments {
+		snapshot.Segments = append(snapshot.Segments, &segment{
+			Start: seg.Start, End: seg.End, Done: atomic.LoadInt64(&seg.Done)})
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, data, 0666)
+}
+
+// rangeSupport reports whether rawURL can be fetched in byte ranges, and its size
+func (d *Downloader) rangeSupport(ctx context.Context, job Job, rawURL string) (int64, bool) {
+	log := d.logger(job)
+	var response *http.Response
+	err := d.withRetries(ctx, job, "HEAD request", func() error {
+		request, _ := http.NewRequest("HEAD", d.currentURL(rawURL), nil)
+		request = request.WithContext(ctx)
+		request.Header.Set("User-Agent", d.userAgent())
+		r, err := d.client().Do(request)
+		if err != nil {
+			return hostDown(err)
+		}
+		r.Body.Close()
+		if httpErr := newHTTPError(r); httpErr.temporary() {
+			return httpErr
+		}
+		response = r
+		return nil
+	})
+	if err != nil {
+		log.Debugf("HEAD %v: %v", rawURL, err)
+		return 0, false
+	}
+	log.Debugf("HEAD %v: HTTP %v, Accept-Ranges: %q, Content-Length: %v",
+		rawURL, response.StatusCode, response.Header.Get("Accept-Ranges"), response.ContentLength)
+	if response.StatusCode >= 300 || response.Header.Get("Accept-Ranges") != "bytes" {
+		return 0, false
+	}
+	return response.ContentLength, response.ContentLength > 0
+}
+
+// fetchSegments downloads the unfinished segments of rawURL into filePath in
+// parallel. Each segment is retried on its own. The state is saved
+// regularly so that an interrupted download can be resumed, and removed
+// once every segment has been received in full.
+func (d *Downloader) fetchSegments(
+	ctx context.Context, job Job, rawURL string, filePath string, state *segments,
+	tracker *progressTracker) error {
+
+	log := d.logger(job)
+	statePath := filePath + segmentsExt
+	output, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	if err := output.Truncate(state.Size); err != nil {
+		return err
+	}
+	if err := state.save(statePath); err != nil {
+		return err
+	}
+	log.Infof("Downloading %v bytes over %v connections", state.Size, len(state.Segments))
+	tracker.setTotal(state.Size)
+	var received int64
+	for _, seg := range state.Segments {
+		received += atomic.LoadInt64(&seg.Done)
+	}
+	tracker.setBytes(received)
+
+	// a segment that fails for good stops the others
+	segCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(state.Segments))
+	for i, seg := range state.Segments {
+		if atomic.LoadInt64(&seg.Done) >= seg.length() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, seg *segment) {
+			defer wg.Done()
+			errs[i] = d.withRetries(segCtx, job, fmt.Sprintf("segment %v", i+1), func() error {
+				return d.fetchSegment(segCtx, d.currentURL(rawURL), output, seg, tracker)
+			})
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i, seg)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-ticker.C:
+			state.save(statePath)
+		}
+	}
+
+	if ctx.Err() != nil {
+		state.save(statePath)
+		return ctx.Err()
+	}
+	for i, err := range errs {
+		if err != nil && err != context.Canceled {
+			state.save(statePath)
+			return fmt.Errorf("Segment %v: %w", i+1, err)
+		}
+	}
+	// integrity check: every byte has been received exactly once
+	received = 0
+	for i, seg := range state.Segments {
+		if seg.Done != seg.length() {
+			state.save(statePath)
+			return fmt.Errorf("Segment %v is incomplete: %v of %v bytes", i+1, seg.Done, seg.length())
+		}
+		received += seg.Done
+	}
+	if received != state.Size {
+		return fmt.Errorf("Incomplete download: received %v of %v bytes", received, state.Size)
+	}
+	if err := output.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(statePath)
+}
+
+// fetchSegment requests the rest of a segment and writes it at its offset
+func (d *Downloader) fetchSegment(
+	ctx context.Context, rawURL string, output *os.File, seg *segment,
+	tracker *progressTracker) error {
+
+	offset := seg.Start + atomic.LoadInt64(&seg.Done)
+	request, _ := http.NewRequest("GET", rawURL, nil)
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", d.userAgent())
+	request.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, seg.End))
+	response, err := d.client().Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return hostDown(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 400 {
+		return newHTTPError(response)
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Expected HTTP 206 for a Range request, got HTTP %v", response.StatusCode)
+	}
+	if start, _, ok := parseContentRange(response.Header.Get("Content-Range")); !ok || start != offset {
+		return fmt.Errorf("Unexpected Content-Range %q", response.Header.Get("Content-Range"))
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		remaining := seg.length() - atomic.LoadInt64(&seg.Done)
+		if remaining <= 0 {
+			return nil
+		}
+		if int64(len(buf)) > remaining {
+			buf = buf[:remaining]
+		}
+		n, readErr := response.Body.Read(buf)
+		if n > 0 {
+			if _, err := output.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+			atomic.AddInt64(&seg.Done, int64(n))
+			tracker.addBytes(int64(n))
+		}
+		if readErr == io.EOF {
+			if atomic.LoadInt64(&seg.Done) < seg.length() {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
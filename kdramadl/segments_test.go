@@ -0,0 +1,283 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContent returns size bytes that differ from one position to the next,
+// so that a segment written at the wrong offset is noticed
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+// rangeLog records the Range headers of the GET requests a test server gets
+type rangeLog struct {
+	mutex  sync.Mutex
+	ranges []string
+}
+
+func (l *rangeLog) add(r *http.Request) {
+	if r.Method != "GET" {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ranges = append(l.ranges, r.Header.Get("Range"))
+}
+
+func (l *rangeLog) get() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.ranges...)
+}
+
+// failingWriter fails after writing limit bytes of the body
+type failingWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ResponseWriter.Write(p[:w.limit])
+		w.limit = 0
+		return n, errors.New("connection dropped")
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// testDownloader returns a Downloader that retries quickly
+func testDownloader(connections int) *Downloader {
+	return &Downloader{
+		Retries:       2,
+		RetryBackoff:  time.Millisecond,
+		RetryMaxDelay: time.Millisecond,
+		Connections:   connections,
+	}
+}
+
+// testFetch downloads url into a new temporary folder and checks that the
+// file and checksum match content and that no state file is left
+func testFetch(t *testing.T, d *Downloader, url string, content []byte) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "video.download")
+	checksum, err := d.fetch(context.Background(), Job{}, url, filePath, false, nil)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	checkDownload(t, filePath, checksum, content)
+}
+
+// checkDownload checks that filePath holds content and checksum is its
+// checksum, and that the state of the segmented download has been removed
+func checkDownload(t *testing.T, filePath string, checksum string, content []byte) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("downloaded %v bytes that differ from the %v served", len(data), len(content))
+	}
+	sum := sha256.Sum256(content)
+	if want := hex.EncodeToString(sum[:]); checksum != want {
+		t.Errorf("checksum %v, want %v", checksum, want)
+	}
+	if _, err := os.Stat(filePath + segmentsExt); !os.IsNotExist(err) {
+		t.Errorf("%v was not removed", filePath+segmentsExt)
+	}
+}
+
+func TestFetchSegments(t *testing.T) {
+	content := testContent(3*minSegmentSize + 123)
+	var log rangeLog
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	testFetch(t, testDownloader(3), server.URL+"/video.mp4", content)
+	ranges := log.get()
+	if len(ranges) != 3 {
+		t.Fatalf("%v requests, want 3: %q", len(ranges), ranges)
+	}
+	for _, r := range ranges {
+		if !strings.HasPrefix(r, "bytes=") {
+			t.Errorf("request without a Range header: %q", ranges)
+		}
+	}
+}
+
+func TestFetchWithoutRangeSupport(t *testing.T) {
+	content := testContent(2*minSegmentSize + 7)
+	var log rangeLog
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r)
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	testFetch(t, testDownloader(4), server.URL+"/video.mp4", content)
+	if ranges := log.get(); len(ranges) != 1 || ranges[0] != "" {
+		t.Errorf("requests %q, want a single one without a Range header", ranges)
+	}
+}
+
+func TestFetchSegmentsRetriesShortSegment(t *testing.T) {
+	content := testContent(2*minSegmentSize + 99)
+	second := newSegments(int64(len(content)), 2).Segments[1]
+	var log rangeLog
+	var dropped sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r)
+		if r.Method == "GET" && r.Header.Get("Range") == fmt.Sprintf("bytes=%v-%v", second.Start, second.End) {
+			// the second segment is cut off the first time
+			drop := false
+			dropped.Do(func() { drop = true })
+			if drop {
+				w = &failingWriter{ResponseWriter: w, limit: 1000}
+			}
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	d := testDownloader(2)
+	retries := 0
+	d.OnRetry = func(Job, Retry) { retries++ }
+	testFetch(t, d, server.URL+"/video.mp4", content)
+	if retries != 1 {
+		t.Errorf("%v retries, want 1", retries)
+	}
+	// the retry continues after the bytes already received
+	ranges := log.get()
+	want := fmt.Sprintf("bytes=%v-%v", second.Start+1000, second.End)
+	if last := ranges[len(ranges)-1]; last != want {
+		t.Errorf("retried with %q, want %q", last, want)
+	}
+}
+
+func TestFetchSegmentsFails(t *testing.T) {
+	content := testContent(2*minSegmentSize + 5)
+	second := newSegments(int64(len(content)), 2).Segments[1]
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && r.Header.Get("Range") == fmt.Sprintf("bytes=%v-%v", second.Start, second.End) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "video.download")
+	_, err = testDownloader(2).fetch(context.Background(), Job{}, server.URL+"/video.mp4", filePath, false, nil)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("got error %v, want HTTP 404", err)
+	}
+	// the state is kept for a later resume
+	if _, err := loadSegments(filePath + segmentsExt); err != nil {
+		t.Errorf("state not saved: %v", err)
+	}
+}
+
+func TestFetchSegmentsResume(t *testing.T) {
+	content := testContent(3*minSegmentSize + 10)
+	var log rangeLog
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "video.download")
+
+	// an interrupted download: the first segment is complete, the second
+	// has 500 bytes and the third has not started
+	state := newSegments(int64(len(content)), 3)
+	state.Segments[0].Done = state.Segments[0].length()
+	state.Segments[1].Done = 500
+	partial := make([]byte, len(content))
+	copy(partial, content[:state.Segments[0].End+1])
+	copy(partial[state.Segments[1].Start:], content[state.Segments[1].Start:state.Segments[1].Start+500])
+	if err := ioutil.WriteFile(filePath, partial, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.save(filePath + segmentsExt); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := testDownloader(3).fetch(context.Background(), Job{}, server.URL+"/video.mp4", filePath, true, nil)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	checkDownload(t, filePath, checksum, content)
+	ranges := log.get()
+	second, third := state.Segments[1], state.Segments[2]
+	want := map[string]bool{
+		fmt.Sprintf("bytes=%v-%v", second.Start+500, second.End): true,
+		fmt.Sprintf("bytes=%v-%v", third.Start, third.End):       true,
+	}
+	if len(ranges) != len(want) {
+		t.Fatalf("requests %q, want %v", ranges, len(want))
+	}
+	for _, r := range ranges {
+		if !want[r] {
+			t.Errorf("unexpected request for %q", r)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// defaultCueLength is how long a cue without a valid end time is shown
+const defaultCueLength = 2 * time.Second
+
+// RepairSRT reads SubRip subtitles that may be broken and fixes the common
+// problems: other encodings than UTF-8, a byte order mark, CRLF line
+// endings, missing blank lines between cues, wrong cue numbers, cues
+// with invalid times, cues that are out of order, end before they start
+// or overlap the next one, and empty cues.
+// A description of each change is returned. An error is returned only if
+// no cues are left.
+func RepairSRT(data []byte) (*Subtitles, []string, error) {
+	text, fixes := decodeSubtitles(data)
+	subs, parseFixes, err := parseSRT(text, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	fixes = append(fixes, parseFixes...)
+	fixes = append(fixes, subs.fixTimes()...)
+	if len(subs.Cues) == 0 {
+		return nil, fixes, errors.New("No subtitles found")
+	}
+	return subs, fixes, nil
+}
+
+// decodeSubtitles returns data as UTF-8 text with LF line endings. UTF-16
+// is recognised by its byte order mark. Text that is not valid UTF-8 is
+// read as Windows-1252, the usual encoding of western SubRip files.
+func decodeSubtitles(data []byte) (string, []string) {
+	var fixes []string
+	var text string
+	switch {
+	case bytes.HasPrefix(data, []byte("\xef\xbb\xbf")):
+		text = string(data[3:])
+		fixes = append(fixes, "removed the UTF-8 byte order mark")
+	case bytes.HasPrefix(data, []byte("\xff\xfe")), bytes.HasPrefix(data, []byte("\xfe\xff")):
+		text = decodeUTF16(data[2:], data[0] == 0xfe)
+		fixes = append(fixes, "converted from UTF-16 to UTF-8")
+	case !utf8.Valid(data):
+		text = decodeWindows1252(data)
+		fixes = append(fixes, "converted from Windows-1252 to UTF-8, as it was not valid UTF-8")
+	default:
+		text = string(data)
+	}
+	if strings.Contains(text, "\r") {
+		text = strings.Replace(text, "\r\n", "\n", -1)
+		text = strings.Replace(text, "\r", "\n", -1)
+		fixes = append(fixes, "converted CRLF line endings to LF")
+	}
+	return text, fixes
+}
+
+// decodeUTF16 decodes UTF-16 text without its byte order mark
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// windows1252 holds the characters of Windows-1252 from 0x80 to 0x9f,
+// which differ from Latin-1
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// decodeWindows1252 decodes Windows-1252 text
+func decodeWindows1252(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		if c >= 0x80 && c < 0xa0 {
+			b.WriteRune(windows1252[c-0x80])
+		} else {
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// fixTimes removes empty cues, sorts the cues by start time and fixes the
+// end times of cues that end before they start or overlap the next cue
+func (s *Subtitles) fixTimes() []string {
+	var fixes []string
+	cues := s.Cues[:0]
+	empty := 0
+	for _, cue := range s.Cues {
+		if strings.TrimSpace(strings.Join(cue.Lines, "")) == "" {
+			empty++
+			continue
+		}
+		cues = append(cues, cue)
+	}
+	s.Cues = cues
+	if empty > 0 {
+		fixes = append(fixes, fmt.Sprintf("removed %v without text", countCues(empty)))
+	}
+
+	if !sort.SliceIsSorted(s.Cues, func(i, j int) bool { return s.Cues[i].Start < s.Cues[j].Start }) {
+		sort.SliceStable(s.Cues, func(i, j int) bool { return s.Cues[i].Start < s.Cues[j].Start })
+		fixes = append(fixes, "sorted the cues by start time")
+	}
+
+	backwards, overlapping := 0, 0
+	for i := range s.Cues {
+		cue := &s.Cues[i]
+		if cue.End <= cue.Start {
+			cue.End = cue.Start + defaultCueLength
+			backwards++
+		}
+		if i+1 < len(s.Cues) {
+			next := s.Cues[i+1].Start
+			if cue.End > next && next > cue.Start {
+				cue.End = next
+				overlapping++
+			}
+		}
+	}
+	if backwards > 0 {
+		fixes = append(fixes, fmt.Sprintf("fixed %v that ended before they started", countCues(backwards)))
+	}
+	if overlapping > 0 {
+		fixes = append(fixes, fmt.Sprintf("shortened %v that overlapped the next one", countCues(overlapping)))
+	}
+	return fixes
+}
+
+// countCues returns "1 cue" or "n cues"
+func countCues(n int) string {
+	if n == 1 {
+		return "1 cue"
+	}
+	return fmt.Sprintf("%v cues", n)
+}
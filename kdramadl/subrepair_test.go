@@ -0,0 +1,121 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRepairSRT(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []Cue
+		wantFixes []string
+	}{
+		{
+			name:  "nothing to repair",
+			input: "1\n00:00:01,000 --> 00:00:02,000\nHello\n",
+			want:  []Cue{{ms(1000), ms(2000), []string{"Hello"}}},
+		},
+		{
+			name:      "byte order mark and CRLF",
+			input:     "\xef\xbb\xbf1\r\n00:00:01,000 --> 00:00:02,000\r\nHello\r\n",
+			want:      []Cue{{ms(1000), ms(2000), []string{"Hello"}}},
+			wantFixes: []string{"removed the UTF-8 byte order mark", "converted CRLF line endings to LF"},
+		},
+		{
+			name:      "UTF-16",
+			input:     "\xff\xfe1\x00\n\x000\x000\x00:\x000\x000\x00:\x000\x001\x00,\x000\x000\x000\x00 \x00-\x00-\x00>\x00 \x000\x000\x00:\x000\x000\x00:\x000\x002\x00,\x000\x000\x000\x00\n\x00\xe9\x00\n\x00",
+			want:      []Cue{{ms(1000), ms(2000), []string{"é"}}},
+			wantFixes: []string{"converted from UTF-16 to UTF-8"},
+		},
+		{
+			name:      "Windows-1252",
+			input:     "1\n00:00:01,000 --> 00:00:02,000\n\x93Caf\xe9\x94\n",
+			want:      []Cue{{ms(1000), ms(2000), []string{"“Café”"}}},
+			wantFixes: []string{"converted from Windows-1252 to UTF-8, as it was not valid UTF-8"},
+		},
+		{
+			name:      "missing blank line",
+			input:     "1\n00:00:01,000 --> 00:00:02,000\nHello\n2\n00:00:03,000 --> 00:00:04,000\nWorld\n",
+			want:      []Cue{{ms(1000), ms(2000), []string{"Hello"}}, {ms(3000), ms(4000), []string{"World"}}},
+			wantFixes: []string{"separated 1 cue not preceded by a blank line"},
+		},
+		{
+			name:      "wrong numbers",
+			input:     "5\n00:00:01,000 --> 00:00:02,000\nHello\n\n00:00:03,000 --> 00:00:04,000\nWorld\n",
+			want:      []Cue{{ms(1000), ms(2000), []string{"Hello"}}, {ms(3000), ms(4000), []string{"World"}}},
+			wantFixes: []string{"renumbered 2 cues"},
+		},
+		{
+			name:      "invalid times",
+			input:     "1\n00:00:01,000 --> 00:00:02,000\nHello\n\n2\n00:00:xx,000 --> 00:00:04,000\nBroken\nlines\n\n3\n00:00:05,000 --> 00:00:06,000\nWorld\n",
+			want:      []Cue{{ms(1000), ms(2000), []string{"Hello"}}, {ms(5000), ms(6000), []string{"World"}}},
+			wantFixes: []string{`skipped the cue at line 6: invalid time "00:00:xx,000"`, "renumbered 1 cue"},
+		},
+		{
+			name:      "out of order",
+			input:     "1\n00:00:03,000 --> 00:00:04,000\nWorld\n\n2\n00:00:01,000 --> 00:00:02,000\nHello\n",
+			want:      []Cue{{ms(1000), ms(2000), []string{"Hello"}}, {ms(3000), ms(4000), []string{"World"}}},
+			wantFixes: []string{"sorted the cues by start time"},
+		},
+		{
+			name:      "overlapping",
+			input:     "1\n00:00:01,000 --> 00:00:03,500\nHello\n\n2\n00:00:03,000 --> 00:00:04,000\nWorld\n",
+			want:      []Cue{{ms(1000), ms(3000), []string{"Hello"}}, {ms(3000), ms(4000), []string{"World"}}},
+			wantFixes: []string{"shortened 1 cue that overlapped the next one"},
+		},
+		{
+			name:      "ends before it starts",
+			input:     "1\n00:00:05,000 --> 00:00:01,000\nHello\n",
+			want:      []Cue{{ms(5000), ms(7000), []string{"Hello"}}},
+			wantFixes: []string{"fixed 1 cue that ended before they started"},
+		},
+		{
+			name:      "empty cue",
+			input:     "1\n00:00:01,000 --> 00:00:02,000\n\n2\n00:00:03,000 --> 00:00:04,000\nWorld\n",
+			want:      []Cue{{ms(3000), ms(4000), []string{"World"}}},
+			wantFixes: []string{"removed 1 cue without text"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subs, fixes, err := RepairSRT([]byte(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(subs.Cues, test.want) {
+				t.Errorf("got %v, want %v", subs.Cues, test.want)
+			}
+			if !reflect.DeepEqual(fixes, test.wantFixes) {
+				t.Errorf("fixes %q, want %q", fixes, test.wantFixes)
+			}
+		})
+	}
+}
+
+func TestRepairSRTWithoutCues(t *testing.T) {
+	for _, input := range []string{"", "\n\n", "<html><body>Not found</body></html>\n"} {
+		if subs, _, err := RepairSRT([]byte(input)); err == nil {
+			t.Errorf("%q: no error, got %v", input, subs.Cues)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subtitle formats
+const (
+	SubtitleSRT = "srt" // SubRip, as served by the host
+	SubtitleVTT = "vtt" // WebVTT, for browser players
+	SubtitleASS = "ass" // Advanced SubStation Alpha, styled with HardSubsStyle
+)
+
+// SubtitleFormats lists the formats subtitles can be saved in.
+// The first one is the default.
+var SubtitleFormats = []string{SubtitleSRT, SubtitleVTT, SubtitleASS}
+
+// Cue is a single subtitle
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Lines []string // Text, which may contain <i>, <b>, <u> and <font> tags
+}
+
+// Subtitles is a list of cues in the order they appear in the file
+type Subtitles struct {
+	Cues []Cue
+}
+
+var srtTimeRegex = regexp.MustCompile(`^(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})$`)
+
+// ParseSRT reads SubRip subtitles. A byte order mark and CRLF line
+// endings are accepted. Use RepairSRT for subtitles that may be broken.
+func ParseSRT(r io.Reader) (*Subtitles, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	subs, _, err := parseSRT(string(data), false)
+	return subs, err
+}
+
+// parseSRT parses the cues in text. If lenient, a cue with invalid times
+// is skipped instead of being an error. A line of cue times within the
+// text of a cue starts a new cue, as the blank line before it is missing.
+// The changes that splitting, renumbering and skipping cues make are
+// returned.
+func parseSRT(text string, lenient bool) (*Subtitles, []string, error) {
+	subs := &Subtitles{}
+	var fixes []string
+	lineNo := 0
+	misnumbered := 0
+	unseparated := 0
+	number := -1 // the number before the next cue's times
+	skipping := false
+	var cue *Cue
+	for _, line := range strings.Split(text, "\n") {
+		lineNo++
+		line = strings.TrimRight(line, "\r")
+		blank := strings.TrimSpace(line) == ""
+		if skipping {
+			skipping = !blank
+			continue
+		}
+		if cue == nil {
+			if blank {
+				continue
+			}
+			if isCueNumber(line) {
+				number, _ = strconv.Atoi(strings.TrimSpace(line))
+				continue
+			}
+			start, end, err := parseSRTTiming(line)
+			if err != nil && !lenient {
+				return nil, nil, fmt.Errorf("line %v: %v", lineNo, err)
+			} else if err != nil {
+				fixes = append(fixes, fmt.Sprintf("skipped the cue at line %v: %v", lineNo, err))
+				skipping = true
+				number = -1
+				continue
+			}
+			if number != len(subs.Cues)+1 {
+				misnumbered++
+			}
+			number = -1
+			cue = &Cue{Start: start, End: end}
+			continue
+		}
+		if blank {
+			subs.Cues = append(subs.Cues, *cue)
+			cue = nil
+			continue
+		}
+		if start, end, err := parseSRTTiming(line); err == nil {
+			// the blank line before this cue is missing, so its number,
+			// if any, was taken as text of the previous one
+			number = -1
+			if n := len(cue.Lines); n > 0 && isCueNumber(cue.Lines[n-1]) {
+				number, _ = strconv.Atoi(strings.TrimSpace(cue.Lines[n-1]))
+				cue.Lines = cue.Lines[:n-1]
+			}
+			subs.Cues = append(subs.Cues, *cue)
+			if number != len(subs.Cues)+1 {
+				misnumbered++
+			}
+			number = -1
+			unseparated++
+			cue = &Cue{Start: start, End: end}
+			continue
+		}
+		cue.Lines = append(cue.Lines, line)
+	}
+	if cue != nil {
+		subs.Cues = append(subs.Cues, *cue)
+	}
+	if unseparated > 0 {
+		fixes = append(fixes, fmt.Sprintf("separated %v not preceded by a blank line", countCues(unseparated)))
+	}
+	if misnumbered > 0 {
+		fixes = append(fixes, fmt.Sprintf("renumbered %v", countCues(misnumbered)))
+	}
+	return subs, fixes, nil
+}
+
+// isCueNumber reports whether a line is the number before a cue's times
+func isCueNumber(line string) bool {
+	_, err := strconv.Atoi(strings.TrimSpace(line))
+	return err == nil
+}
+
+// parseSRTTiming parses "00:00:01,000 --> 00:00:02,500", ignoring any
+// position after the end time
+func parseSRTTiming(line string) (time.Duration, time.Duration, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "-->" {
+		return 0, 0, fmt.Errorf("expected cue times, found %q", line)
+	}
+	start, err := parseSRTTime(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseSRTTime(fields[2])
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// parseSRTTime parses a time such as 01:02:03,456
+func parseSRTTime(s string) (time.Duration, error) {
+	m := srtTimeRegex.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	hours, _ := strconv.Atoi(m[1])
+	minutes, _ := strconv.Atoi(m[2])
+	seconds, _ := strconv.Atoi(m[3])
+	// ",5" is half a second
+	millis, _ := strconv.Atoi((m[4] + "00")[:3])
+	if minutes > 59 || seconds > 59 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second + time.Duration(millis)*time.Millisecond, nil
+}
+
+// formatSubTime formats t as hours, minutes, seconds and fractions of a
+// second with the given separator and number of decimals
+func formatSubTime(t time.Duration, hourDigits int, sep string, decimals int) string {
+	if t < 0 {
+		t = 0
+	}
+	unit := time.Second
+	for i := 0; i < decimals; i++ {
+		unit /= 10
+	}
+	t = t.Round(unit)
+	fraction := (t % time.Second) / unit
+	return fmt.Sprintf("%0*d:%02d:%02d%v%0*d", hourDigits, int(t/time.Hour),
+		int(t/time.Minute%60), int(t/time.Second%60), sep, decimals, int(fraction))
+}
+
+// WriteSRT writes the subtitles in SubRip format, numbering the cues from 1
+func (s *Subtitles) WriteSRT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i, cue := range s.Cues {
+		fmt.Fprintf(bw, "%v\n%v --> %v\n", i+1,
+			formatSubTime(cue.Start, 2, ",", 3), formatSubTime(cue.End, 2, ",", 3))
+		for _, line := range cue.Lines {
+			fmt.Fprintf(bw, "%v\n", line)
+		}
+		fmt.Fprint(bw, "\n")
+	}
+	return bw.Flush()
+}
+
+var (
+	fontTagRegex = regexp.MustCompile(`(?i)</?font[^>]*>`)
+	assTagRegex  = regexp.MustCompile(`\{\\[^}]*\}`)
+)
+
+// WriteVTT writes the subtitles in WebVTT format. Font tags and ASS
+// override codes, which browsers do not support, are removed.
+func (s *Subtitles) WriteVTT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "WEBVTT\n\n")
+	for _, cue := range s.Cues {
+		fmt.Fprintf(bw, "%v --> %v\n",
+			formatSubTime(cue.Start, 2, ".", 3), formatSubTime(cue.End, 2, ".", 3))
+		for _, line := range cue.Lines {
+			line = assTagRegex.ReplaceAllString(fontTagRegex.ReplaceAllString(line, ""), "")
+			// a blank line or "-->" would end the cue early
+			line = strings.Replace(line, "-->", "->", -1)
+			if strings.TrimSpace(line) != "" {
+				fmt.Fprintf(bw, "%v\n", line)
+			}
+		}
+		fmt.Fprint(bw, "\n")
+	}
+	return bw.Flush()
+}
+
+// assStyleFields are the fields of an ASS style with the values ffmpeg uses
+// when it converts SubRip subtitles
+var assStyleFields = []struct{ name, value string }{
+	{"Name", "Default"}, {"Fontname", "Arial"}, {"Fontsize", "16"},
+	{"PrimaryColour", "&Hffffff"}, {"SecondaryColour", "&Hffffff"},
+	{"OutlineColour", "&H0"}, {"BackColour", "&H0"},
+	{"Bold", "0"}, {"Italic", "0"}, {"Underline", "0"}, {"StrikeOut", "0"},
+	{"ScaleX", "100"}, {"ScaleY", "100"}, {"Spacing", "0"}, {"Angle", "0"},
+	{"BorderStyle", "1"}, {"Outline", "1"}, {"Shadow", "0"}, {"Alignment", "2"},
+	{"MarginL", "10"}, {"MarginR", "10"}, {"MarginV", "10"}, {"Encoding", "0"},
+}
+
+// assStyle returns the names and values of the Default style with the
+// overrides in style, which has the same form as ffmpeg's force_style,
+// e.g. "FontSize=22,PrimaryColour=&H00FF0000"
+func assStyle(style string) ([]string, []string, error) {
+	names := make([]string, len(assStyleFields))
+	values := make([]string, len(assStyleFields))
+	for i, f := range assStyleFields {
+		names[i], values[i] = f.name, f.value
+	}
+	for _, override := range strings.Split(style, ",") {
+		if strings.TrimSpace(override) == "" {
+			continue
+		}
+		kv := strings.SplitN(override, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, fmt.Errorf("invalid style %q, expected Name=Value", override)
+		}
+		found := false
+		for i, name := range names {
+			if strings.EqualFold(name, strings.TrimSpace(kv[0])) && name != "Name" {
+				values[i] = strings.TrimSpace(kv[1])
+				found = true
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("unknown style field %q", kv[0])
+		}
+	}
+	return names, values, nil
+}
+
+var assTextReplacer = strings.NewReplacer(
+	"<i>", `{\i1}`, "</i>", `{\i0}`, "<b>", `{\b1}`, "</b>", `{\b0}`,
+	"<u>", `{\u1}`, "</u>", `{\u0}`, "<s>", `{\s1}`, "</s>", `{\s0}`,
+	"<I>", `{\i1}`, "</I>", `{\i0}`, "<B>", `{\b1}`, "</B>", `{\b0}`,
+	"<U>", `{\u1}`, "</U>", `{\u0}`, "<S>", `{\s1}`, "</S>", `{\s0}`,
+)
+
+// WriteASS writes the subtitles in ASS format with a Default style that
+// has the overrides in style, e.g. "FontSize=22,PrimaryColour=&H00FF0000"
+func (s *Subtitles) WriteASS(w io.Writer, style string) error {
+	names, values, err := assStyle(style)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "[Script Info]\nScriptType: v4.00+\nPlayResX: 384\nPlayResY: 288\nScaledBorderAndShadow: yes\n\n")
+	fmt.Fprintf(bw, "[V4+ Styles]\nFormat: %v\nStyle: %v\n\n",
+		strings.Join(names, ", "), strings.Join(values, ","))
+	fmt.Fprint(bw, "[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+	for _, cue := range s.Cues {
+		text := assTextReplacer.Replace(fontTagRegex.ReplaceAllString(strings.Join(cue.Lines, "\n"), ""))
+		text = strings.Replace(text, "\n", `\N`, -1)
+		fmt.Fprintf(bw, "Dialogue: 0,%v,%v,Default,,0,0,0,,%v\n",
+			formatSubTime(cue.Start, 1, ".", 2), formatSubTime(cue.End, 1, ".", 2), text)
+	}
+	return bw.Flush()
+}
+
+// Shift changes the times of the cues to time*scale + offset, to match a
+// video with a different cut or framerate. A scale of 0 is the same as 1.
+// Cues that would end before the start of the video are removed and their
+// number is returned.
+func (s *Subtitles) Shift(offset time.Duration, scale float64) int {
+	if scale == 0 {
+		scale = 1
+	}
+	cues := s.Cues[:0]
+	for _, cue := range s.Cues {
+		cue.Start = time.Duration(float64(cue.Start)*scale) + offset
+		cue.End = time.Duration(float64(cue.End)*scale) + offset
+		if cue.End <= 0 {
+			continue
+		}
+		if cue.Start < 0 {
+			cue.Start = 0
+		}
+		cues = append(cues, cue)
+	}
+	removed := len(s.Cues) - len(cues)
+	s.Cues = cues
+	return removed
+}
+
+// Clip keeps the cues shown between start and end, with times relative to
+// start, for a clip cut out of the video. An end of 0 means the end of the
+// video. The number of removed cues is returned.
+func (s *Subtitles) Clip(start, end time.Duration) int {
+	removed := s.Shift(-start, 1)
+	if end == 0 {
+		return removed
+	}
+	length := end - start
+	cues := s.Cues[:0]
+	for _, cue := range s.Cues {
+		if cue.Start >= length {
+			continue
+		}
+		if cue.End > length {
+			cue.End = length
+		}
+		cues = append(cues, cue)
+	}
+	removed += len(s.Cues) - len(cues)
+	s.Cues = cues
+	return removed
+}
+
+// Write writes the subtitles in one of SubtitleFormats. style is only
+// used for SubtitleASS.
+func (s *Subtitles) Write(w io.Writer, format string, style string) error {
+	switch format {
+	case SubtitleSRT, "":
+		return s.WriteSRT(w)
+	case SubtitleVTT:
+		return s.WriteVTT(w)
+	case SubtitleASS:
+		return s.WriteASS(w, style)
+	}
+	return fmt.Errorf("Invalid subtitle format: %v", format)
+}
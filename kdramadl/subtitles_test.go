@@ -0,0 +1,150 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ms is a shorthand for cue times
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+func TestParseSRT(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []Cue
+		wantErr bool
+	}{
+		{
+			name:  "plain",
+			input: "1\n00:00:01,000 --> 00:00:02,500\nHello\n\n2\n00:00:03,000 --> 00:00:04,000\nWorld\n",
+			want:  []Cue{{ms(1000), ms(2500), []string{"Hello"}}, {ms(3000), ms(4000), []string{"World"}}},
+		},
+		{
+			name:  "byte order mark",
+			input: "\xef\xbb\xbf1\n00:00:01,000 --> 00:00:02,000\nHello\n",
+			want:  []Cue{{ms(1000), ms(2000), []string{"Hello"}}},
+		},
+		{
+			name:  "CRLF",
+			input: "1\r\n00:00:01,000 --> 00:00:02,000\r\nHello\r\nthere\r\n\r\n2\r\n00:00:03,000 --> 00:00:04,000\r\nWorld\r\n",
+			want:  []Cue{{ms(1000), ms(2000), []string{"Hello", "there"}}, {ms(3000), ms(4000), []string{"World"}}},
+		},
+		{
+			name:  "missing blank line",
+			input: "1\n00:00:01,000 --> 00:00:02,000\nHello\n2\n00:00:03,000 --> 00:00:04,000\nWorld",
+			want:  []Cue{{ms(1000), ms(2000), []string{"Hello"}}, {ms(3000), ms(4000), []string{"World"}}},
+		},
+		{
+			name:  "short fractions, positions and extra blank lines",
+			input: "\n\n1\n0:00:01.5 --> 00:00:02,25 X1:10 X2:20\nHello\n\n\n\n",
+			want:  []Cue{{ms(1500), ms(2250), []string{"Hello"}}},
+		},
+		{
+			name:    "invalid time",
+			input:   "1\n00:00:01,000 --> 00:61:00,000\nHello\n",
+			wantErr: true,
+		},
+		{
+			name:    "not subtitles",
+			input:   "<html>\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subs, err := ParseSRT(strings.NewReader(test.input))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("no error, parsed %v", subs.Cues)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(subs.Cues, test.want) {
+				t.Errorf("got %v, want %v", subs.Cues, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteSubtitles(t *testing.T) {
+	subs := &Subtitles{Cues: []Cue{
+		{ms(1000), ms(2500), []string{"<i>Hello</i>", `<font color="red">there</font>`}},
+		{ms(3723004), ms(3724000), []string{"a --> b"}},
+	}}
+	tests := []struct {
+		format string
+		style  string
+		want   string
+	}{
+		{
+			format: SubtitleSRT,
+			want: "1\n00:00:01,000 --> 00:00:02,500\n<i>Hello</i>\n<font color=\"red\">there</font>\n\n" +
+				"2\n01:02:03,004 --> 01:02:04,000\na --> b\n\n",
+		},
+		{
+			format: SubtitleVTT,
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\n<i>Hello</i>\nthere\n\n" +
+				"01:02:03.004 --> 01:02:04.000\na -> b\n\n",
+		},
+		{
+			format: SubtitleASS,
+			style:  "FontSize=22,PrimaryColour=&H00FF0000",
+			want: "[Script Info]\nScriptType: v4.00+\nPlayResX: 384\nPlayResY: 288\nScaledBorderAndShadow: yes\n\n" +
+				"[V4+ Styles]\nFormat: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, " +
+				"Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, " +
+				"Alignment, MarginL, MarginR, MarginV, Encoding\n" +
+				"Style: Default,Arial,22,&H00FF0000,&Hffffff,&H0,&H0,0,0,0,0,100,100,0,0,1,1,0,2,10,10,10,0\n\n" +
+				"[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+				`Dialogue: 0,0:00:01.00,0:00:02.50,Default,,0,0,0,,{\i1}Hello{\i0}\Nthere` + "\n" +
+				"Dialogue: 0,1:02:03.00,1:02:04.00,Default,,0,0,0,,a --> b\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := subs.Write(&out, test.format, test.style); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != test.want {
+				t.Errorf("got\n%v\nwant\n%v", out.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestWriteSubtitlesErrors(t *testing.T) {
+	subs := &Subtitles{Cues: []Cue{{ms(0), ms(1000), []string{"Hello"}}}}
+	if err := subs.Write(&bytes.Buffer{}, "sub", ""); err == nil {
+		t.Error("no error for an unknown format")
+	}
+	if err := subs.Write(&bytes.Buffer{}, SubtitleASS, "Size=22"); err == nil {
+		t.Error("no error for an unknown style field")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Tags are written into the container so that media servers such as Plex
+// or Jellyfin can show the episode and its tracks. Blank values are left
+// out. gif and webp get no tags.
+type Tags struct {
+	Title   string
+	Show    string
+	Season  *int   // nil if unknown, 0 for specials
+	Episode *int   // nil if unknown
+	Date    string // Air date, e.g. 2017 or 2017-05-21
+
+	AudioLanguage    string // ISO 639-2 code of the audio, e.g. kor
+	AudioTitle       string // Defaults to the name of AudioLanguage
+	SubtitleLanguage string // ISO 639-2 code of the subtitles, e.g. eng
+	SubtitleTitle    string // Defaults to the name of SubtitleLanguage
+}
+
+var (
+	validLanguageRegex = regexp.MustCompile(`^[a-z]{3}$`)
+	validDateRegex     = regexp.MustCompile(`^[0-9]{4}(-[0-9]{2}(-[0-9]{2})?)?$`)
+)
+
+// languageNames holds the track titles of common languages
+var languageNames = map[string]string{
+	"eng": "English",
+	"kor": "Korean",
+	"jpn": "Japanese",
+	"chi": "Chinese",
+	"zho": "Chinese",
+	"spa": "Spanish",
+	"por": "Portuguese",
+	"fre": "French",
+	"fra": "French",
+	"ger": "German",
+	"deu": "German",
+	"ind": "Indonesian",
+	"may": "Malay",
+	"msa": "Malay",
+	"tha": "Thai",
+	"vie": "Vietnamese",
+	"ara": "Arabic",
+}
+
+// check returns an error if the tags have an invalid language or date
+func (t Tags) check() error {
+	for _, language := range []string{t.AudioLanguage, t.SubtitleLanguage} {
+		if language != "" && !validLanguageRegex.MatchString(language) {
+			return fmt.Errorf("Invalid language %q, use a three letter code such as eng", language)
+		}
+	}
+	if t.Date != "" && !validDateRegex.MatchString(t.Date) {
+		return fmt.Errorf("Invalid date %q, use YYYY-MM-DD", t.Date)
+	}
+	if (t.Season != nil && *t.Season < 0) || (t.Episode != nil && *t.Episode < 0) {
+		return errors.New("Invalid season or episode")
+	}
+	return nil
+}
+
+// args returns the ffmpeg options that write the tags into container c.
+// subtitles tells whether the output has a subtitle stream.
+func (t Tags) args(c container, subtitles bool) []string {
+	if c.filter != "" {
+		return nil
+	}
+	var args []string
+	tag := func(spec, key, value string) {
+		if value != "" {
+			args = append(args, spec, fmt.Sprintf("%v=%v", key, value))
+		}
+	}
+	number := func(n *int) string {
+		if n == nil {
+			return ""
+		}
+		return strconv.Itoa(*n)
+	}
+	tag("-metadata", "title", t.Title)
+	tag("-metadata", "show", t.Show)
+	if c.audioOnly() {
+		// music players know the show as the album
+		tag("-metadata", "album", t.Show)
+		tag("-metadata", "track", number(t.Episode))
+	}
+	tag("-metadata", "season_number", number(t.Season))
+	tag("-metadata", "episode_sort", number(t.Episode))
+	tag("-metadata", "date", t.Date)
+	if !c.noAudio {
+		tag("-metadata:s:a:0", "language", t.AudioLanguage)
+		tag("-metadata:s:a:0", "title", trackTitle(t.AudioTitle, t.AudioLanguage))
+	}
+	if subtitles {
+		tag("-metadata:s:s:0", "language", t.SubtitleLanguage)
+		tag("-metadata:s:s:0", "title", trackTitle(t.SubtitleTitle, t.SubtitleLanguage))
+	}
+	return args
+}
+
+// trackTitle returns title, or the name of language if title is blank
+func trackTitle(title, language string) string {
+	if title != "" {
+		return title
+	}
+	return languageNames[language]
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kdramadl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagsArgs(t *testing.T) {
+	zero, one, three := 0, 1, 3
+	all := Tags{Title: "Goblin_E01", Show: "Goblin", Season: &one, Episode: &three, Date: "2016-12-02",
+		AudioLanguage: "kor", SubtitleLanguage: "eng", SubtitleTitle: "English_(SDH)"}
+	tests := []struct {
+		name      string
+		tags      Tags
+		format    string
+		subtitles bool
+		want      string
+	}{
+		{"mkv", all, FormatMKV, true, "-metadata title=Goblin_E01 -metadata show=Goblin " +
+			"-metadata season_number=1 -metadata episode_sort=3 -metadata date=2016-12-02 " +
+			"-metadata:s:a:0 language=kor -metadata:s:a:0 title=Korean " +
+			"-metadata:s:s:0 language=eng -metadata:s:s:0 title=English_(SDH)"},
+		{"no subtitle stream", all, FormatMP4, false, "-metadata title=Goblin_E01 -metadata show=Goblin " +
+			"-metadata season_number=1 -metadata episode_sort=3 -metadata date=2016-12-02 " +
+			"-metadata:s:a:0 language=kor -metadata:s:a:0 title=Korean"},
+		{"audio only", all, FormatM4A, false, "-metadata title=Goblin_E01 -metadata show=Goblin " +
+			"-metadata album=Goblin -metadata track=3 " +
+			"-metadata season_number=1 -metadata episode_sort=3 -metadata date=2016-12-02 " +
+			"-metadata:s:a:0 language=kor -metadata:s:a:0 title=Korean"},
+		{"gif", all, FormatGIF, false, ""},
+		{"webp", all, FormatWebP, false, ""},
+		{"blank", Tags{}, FormatMKV, true, ""},
+		{"specials", Tags{Season: &zero, Episode: &zero}, FormatMP3, false,
+			"-metadata track=0 -metadata season_number=0 -metadata episode_sort=0"},
+		{"unknown language", Tags{AudioLanguage: "xyz", AudioTitle: "Dub", SubtitleLanguage: "abc"}, FormatMKV, true,
+			"-metadata:s:a:0 language=xyz -metadata:s:a:0 title=Dub -metadata:s:s:0 language=abc"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.tags.args(containers[test.format], test.subtitles)
+			if want := strings.Fields(test.want); !reflect.DeepEqual(got, want) && len(got)+len(want) > 0 {
+				t.Errorf("got args\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestTagsCheck(t *testing.T) {
+	zero, negative := 0, -1
+	tests := []struct {
+		tags Tags
+		ok   bool
+	}{
+		{Tags{}, true},
+		{Tags{Season: &zero, Episode: &zero, Date: "2017", AudioLanguage: "kor", SubtitleLanguage: "eng"}, true},
+		{Tags{Date: "2017-05-21"}, true},
+		{Tags{Season: &negative}, false},
+		{Tags{Episode: &negative}, false},
+		{Tags{Date: "21/05/2017"}, false},
+		{Tags{AudioLanguage: "korean"}, false},
+		{Tags{SubtitleLanguage: "EN"}, false},
+	}
+	for _, test := range tests {
+		if err := test.tags.check(); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v, want ok %v", test.tags, err, test.ok)
+		}
+	}
+}
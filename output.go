@@ -0,0 +1,387 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+// Output modes
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// outputMode is set from --output. In json mode newline-delimited json
+// events are written to stdout and log messages go to stderr.
+var outputMode = outputText
+
+// logOutput is where log messages are printed
+var logOutput io.Writer = os.Stdout
+
+// setOutputMode switches between text and json output
+func setOutputMode(mode string) error {
+	switch mode {
+	case outputText:
+		logOutput = os.Stdout
+	case outputJSON:
+		logOutput = os.Stderr
+	default:
+		return withCode(codeInvalidOption, fmt.Errorf("Invalid output: %v", mode))
+	}
+	outputMode = mode
+	return nil
+}
+
+// Error codes reported in json error events. These are part of the json
+// output and must not change once released.
+const (
+	codeInvalidOption         = "invalid_option"
+	codeInvalidJob            = "invalid_job"
+	codeInvalidQueue          = "invalid_queue"
+	codeInvalidCode           = "invalid_code"
+	codeResolutionUnavailable = "resolution_unavailable"
+	codeRateLimited           = "rate_limited"
+	codeHostDown              = "host_down"
+	codeFFmpegFailed          = "ffmpeg_failed"
+	codeFFmpegNotFound        = "ffmpeg_not_found"
+	codeDownloadFailed        = "download_failed"
+	codeBatchFailed           = "batch_failed"
+	codeCancelled             = "cancelled"
+	codeFileExists            = "file_exists"
+)
+
+// libraryCodes are the codes for the errors of the kdramadl package
+var libraryCodes = []struct {
+	err  error
+	code string
+}{
+	{kdramadl.ErrInvalidCode, codeInvalidCode},
+	{kdramadl.ErrResolutionUnavailable, codeResolutionUnavailable},
+	{kdramadl.ErrRateLimited, codeRateLimited},
+	{kdramadl.ErrHostDown, codeHostDown},
+	{kdramadl.ErrFFmpegFailed, codeFFmpegFailed},
+	{kdramadl.ErrFileExists, codeFileExists},
+}
+
+// exitCodes are the process exit codes for each error code so that scripts
+// can decide whether to try again. Unlisted codes exit with 1.
+var exitCodes = map[string]int{
+	codeInvalidOption:         2,
+	codeInvalidJob:            2,
+	codeInvalidQueue:          2,
+	codeInvalidCode:           3,
+	codeResolutionUnavailable: 4,
+	codeRateLimited:           5,
+	codeHostDown:              6,
+	codeFFmpegFailed:          7,
+	codeFFmpegNotFound:        8,
+	codeBatchFailed:           9,
+	codeFileExists:            10,
+	codeCancelled:             130,
+}
+
+// codedError is an error with a machine-readable code
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withCode attaches a code to err
+func withCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// errorCode returns the code for err, defaulting to codeDownloadFailed.
+// Errors from the kdramadl package take precedence over the code attached
+// by the caller, which only describes where the error happened.
+func errorCode(err error) string {
+	if errors.Is(err, errCancelled) || errors.Is(err, context.Canceled) {
+		return codeCancelled
+	}
+	for _, c := range libraryCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return codeDownloadFailed
+}
+
+// exitCode returns the process exit code for err
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if code, ok := exitCodes[errorCode(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+// Event names
+const (
+	eventStarted       = "started"
+	eventSubtitleSaved = "subtitle_saved"
+	eventProgress      = "progress"
+	eventRetrying      = "retrying"
+	eventVideoSaved    = "video_saved"
+	eventError         = "error"
+	eventQualities     = "qualities"
+	eventSkipped       = "skipped"
+	eventHistory       = "history"
+)
+
+// jobInfo identifies the job an event belongs to
+type jobInfo struct {
+	Code       string `json:"code"`
+	FileName   string `json:"filename"`
+	Resolution string `json:"resolution"`
+	Format     string `json:"format,omitempty"`
+	Folder     string `json:"folder,omitempty"`
+}
+
+// eventHeader holds the fields common to all events
+type eventHeader struct {
+	Event string   `json:"event"`
+	Time  string   `json:"time"`
+	Job   *jobInfo `json:"job,omitempty"`
+}
+
+type savedEvent struct {
+	eventHeader
+	Path         string   `json:"path"`
+	Size         int64    `json:"size"`
+	SubtitlePath string   `json:"subtitle_path,omitempty"`
+	Repairs      []string `json:"repairs,omitempty"`
+	SHA256       string   `json:"sha256,omitempty"`
+	SourceSHA256 string   `json:"source_sha256,omitempty"`
+	Elapsed      float64  `json:"elapsed,omitempty"`
+}
+
+type progressEvent struct {
+	eventHeader
+	Stage    string   `json:"stage"`
+	Bytes    int64    `json:"bytes"`
+	Total    int64    `json:"total,omitempty"`
+	Percent  *float64 `json:"percent,omitempty"`
+	Position float64  `json:"position,omitempty"`
+	Duration float64  `json:"duration,omitempty"`
+	Rate     float64  `json:"rate"`
+	ETA      *float64 `json:"eta,omitempty"`
+	Elapsed  float64  `json:"elapsed"`
+	Done     bool     `json:"done"`
+}
+
+type retryEvent struct {
+	eventHeader
+	Attempt int     `json:"attempt"`
+	Retries int     `json:"retries"`
+	Delay   float64 `json:"delay"`
+	Message string  `json:"message"`
+}
+
+type qualityInfo struct {
+	Resolution string  `json:"resolution"`
+	Available  bool    `json:"available"`
+	Size       int64   `json:"size,omitempty"`
+	Duration   float64 `json:"duration,omitempty"`
+}
+
+type qualitiesEvent struct {
+	eventHeader
+	Code      string        `json:"code"`
+	Qualities []qualityInfo `json:"qualities"`
+}
+
+type skippedEvent struct {
+	eventHeader
+	Reason     string `json:"reason"`
+	Path       string `json:"path"`
+	Downloaded string `json:"downloaded,omitempty"`
+}
+
+// Reasons for skipping a download
+const (
+	skipDownloaded = "downloaded" // it is in the history
+	skipExists     = "exists"     // a file exists and --on-conflict is skip
+)
+
+type historyEvent struct {
+	eventHeader
+	historyEntry
+}
+
+type errorEvent struct {
+	eventHeader
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newEventHeader creates the common fields of an event. j may be nil.
+func newEventHeader(name string, j *kdramadl.Job) eventHeader {
+	header := eventHeader{Event: name, Time: time.Now().UTC().Format(time.RFC3339)}
+	if j != nil {
+		header.Job = &jobInfo{
+			Code:       j.Code,
+			FileName:   j.FileName,
+			Resolution: j.Resolution,
+			Format:     j.Format,
+			Folder:     j.Folder,
+		}
+	}
+	return header
+}
+
+// emit writes an event as a line of json in json mode
+func emit(event interface{}) {
+	if outputMode != outputJSON {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Unable to encode event: %v", err)
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	os.Stdout.Write(append(data, '\n'))
+}
+
+func emitStarted(j kdramadl.Job) {
+	emit(newEventHeader(eventStarted, &j))
+}
+
+func emitSubtitleSaved(j kdramadl.Job, result *kdramadl.SubtitleResult) {
+	emit(savedEvent{
+		eventHeader: newEventHeader(eventSubtitleSaved, &j),
+		Path:        result.Path,
+		Size:        result.Size,
+		Repairs:     result.Repairs,
+	})
+}
+
+func emitVideoSaved(j kdramadl.Job, result *kdramadl.VideoResult) {
+	emit(savedEvent{
+		eventHeader:  newEventHeader(eventVideoSaved, &j),
+		Path:         result.Path,
+		Size:         result.Size,
+		SubtitlePath: result.SubtitlePath,
+		SHA256:       result.SHA256,
+		SourceSHA256: result.SourceSHA256,
+		Elapsed:      result.Elapsed.Seconds(),
+	})
+}
+
+func emitProgress(j kdramadl.Job, p kdramadl.Progress) {
+	event := progressEvent{
+		eventHeader: newEventHeader(eventProgress, &j),
+		Stage:       p.Stage,
+		Bytes:       p.Bytes,
+		Total:       p.Total,
+		Position:    p.Position.Seconds(),
+		Duration:    p.Duration.Seconds(),
+		Rate:        p.Rate,
+		Elapsed:     p.Elapsed.Seconds(),
+		Done:        p.Done,
+	}
+	if fraction := p.Fraction(); fraction >= 0 {
+		percent := fraction * 100
+		event.Percent = &percent
+	}
+	if eta := p.ETA(); eta >= 0 && !p.Done {
+		seconds := eta.Seconds()
+		event.ETA = &seconds
+	}
+	emit(event)
+}
+
+func emitRetrying(j kdramadl.Job, r kdramadl.Retry) {
+	emit(retryEvent{
+		eventHeader: newEventHeader(eventRetrying, &j),
+		Attempt:     r.Attempt,
+		Retries:     r.Retries,
+		Delay:       r.Delay.Seconds(),
+		Message:     r.Err.Error(),
+	})
+}
+
+func emitQualities(code string, qualities []kdramadl.Quality) {
+	event := qualitiesEvent{
+		eventHeader: newEventHeader(eventQualities, nil),
+		Code:        code,
+		Qualities:   []qualityInfo{},
+	}
+	for _, q := range qualities {
+		info := qualityInfo{Resolution: q.Resolution, Available: q.Available, Duration: q.Duration.Seconds()}
+		if q.Size > 0 {
+			info.Size = q.Size
+		}
+		event.Qualities = append(event.Qualities, info)
+	}
+	emit(event)
+}
+
+func emitSkipped(j kdramadl.Job, e historyEntry) {
+	emit(skippedEvent{
+		eventHeader: newEventHeader(eventSkipped, &j),
+		Reason:      skipDownloaded,
+		Path:        e.Path,
+		Downloaded:  e.Time.Format(time.RFC3339),
+	})
+}
+
+func emitExists(j kdramadl.Job, path string) {
+	emit(skippedEvent{
+		eventHeader: newEventHeader(eventSkipped, &j),
+		Reason:      skipExists,
+		Path:        path,
+	})
+}
+
+// emitError reports an error with its code. j may be nil.
+func emitError(j *kdramadl.Job, err error) {
+	emit(errorEvent{
+		eventHeader: newEventHeader(eventError, j),
+		Code:        errorCode(err),
+		Message:     err.Error(),
+	})
+}
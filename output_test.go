@@ -0,0 +1,142 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code string
+		exit int
+	}{
+		{"invalid code", kdramadl.ErrInvalidCode, codeInvalidCode, 3},
+		{"invalid code from host", &kdramadl.HTTPError{StatusCode: 404, Err: kdramadl.ErrInvalidCode}, codeInvalidCode, 3},
+		{"resolution unavailable", fmt.Errorf("%w: none of 720p", kdramadl.ErrResolutionUnavailable), codeResolutionUnavailable, 4},
+		{"rate limited", &kdramadl.HTTPError{StatusCode: 429, Err: kdramadl.ErrRateLimited}, codeRateLimited, 5},
+		{"host down", &kdramadl.HTTPError{StatusCode: 503, Err: kdramadl.ErrHostDown}, codeHostDown, 6},
+		{"ffmpeg failed", &kdramadl.FFmpegError{ExitCode: 1, Err: errors.New("exit status 1")}, codeFFmpegFailed, 7},
+		{"file exists", fmt.Errorf("%w: ep1.mkv", kdramadl.ErrFileExists), codeFileExists, 10},
+		{"http error", &kdramadl.HTTPError{StatusCode: 403}, codeDownloadFailed, 1},
+		{"invalid option", withCode(codeInvalidOption, errors.New("bad")), codeInvalidOption, 2},
+		{"invalid job", withCode(codeInvalidJob, errors.New("bad")), codeInvalidJob, 2},
+		{"invalid queue", withCode(codeInvalidQueue, errors.New("bad")), codeInvalidQueue, 2},
+		{"ffmpeg not found", withCode(codeFFmpegNotFound, errors.New("missing")), codeFFmpegNotFound, 8},
+		{"batch failed", withCode(codeBatchFailed, errors.New("2 failed")), codeBatchFailed, 9},
+		{"library error over caller's code", withCode(codeInvalidJob, kdramadl.ErrInvalidCode), codeInvalidCode, 3},
+		{"cancelled", errCancelled, codeCancelled, 130},
+		{"context cancelled", fmt.Errorf("downloading: %w", context.Canceled), codeCancelled, 130},
+		{"cancelled over caller's code", withCode(codeBatchFailed, errCancelled), codeCancelled, 130},
+		{"other", errors.New("disk full"), codeDownloadFailed, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := errorCode(test.err); code != test.code {
+				t.Errorf("got code %v, want %v", code, test.code)
+			}
+			if exit := exitCode(test.err); exit != test.exit {
+				t.Errorf("got exit code %v, want %v", exit, test.exit)
+			}
+		})
+	}
+	if exit := exitCode(nil); exit != 0 {
+		t.Errorf("got exit code %v without an error, want 0", exit)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kdramadl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stdout, err := os.Create(dir + "/stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(dir + "/stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	realStdout, realStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	defer func() {
+		os.Stdout, os.Stderr = realStdout, realStderr
+		setOutputMode(outputText)
+	}()
+	if err := setOutputMode(outputJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	j := kdramadl.Job{Code: "abc", FileName: "Ep \"1\"\nfinale", Resolution: "720p", Format: "mkv"}
+	logger.Infof("Downloading %v", j.FileName)
+	emitStarted(j)
+	emitProgress(j, kdramadl.Progress{Stage: "video", Bytes: 50, Total: 100, Rate: 10, Elapsed: time.Second})
+	logger.Warningf("Slow host")
+	emitRetrying(j, kdramadl.Retry{Attempt: 1, Retries: 3, Delay: time.Second, Err: errors.New("line one\nline two")})
+	emitQualities("abc", []kdramadl.Quality{{Resolution: "720p", Available: true, Size: 100}})
+	emitVideoSaved(j, &kdramadl.VideoResult{Path: "ep1.mkv", Size: 100})
+	emitError(nil, withCode(codeBatchFailed, errors.New("1 failed")))
+
+	out, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	want := []string{eventStarted, eventProgress, eventRetrying, eventQualities, eventVideoSaved, eventError}
+	if len(lines) != len(want) {
+		t.Fatalf("got %v lines on stdout, want %v:\n%s", len(lines), len(want), out)
+	}
+	for i, line := range lines {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Errorf("line %v is not json: %v\n%v", i+1, err, line)
+			continue
+		}
+		if event["event"] != want[i] {
+			t.Errorf("line %v is a %v event, want %v", i+1, event["event"], want[i])
+		}
+	}
+	logs, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(logs, []byte("Downloading")) || !bytes.Contains(logs, []byte("Slow host")) {
+		t.Errorf("log messages missing from stderr:\n%s", logs)
+	}
+	if bytes.Contains(logs, []byte(`"event"`)) {
+		t.Errorf("events written to stderr:\n%s", logs)
+	}
+}
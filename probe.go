@@ -0,0 +1,62 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+// showQualities prints a table of the qualities, or emits them in json mode
+func showQualities(code string, qualities []kdramadl.Quality) {
+	if outputMode == outputJSON {
+		emitQualities(code, qualities)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Resolution\tAvailable\tSize\tDuration\n")
+	for _, q := range qualities {
+		available, size, duration := "no", "", ""
+		if q.Available {
+			available = "yes"
+			size, duration = "unknown", "unknown"
+		}
+		if q.Size >= 0 {
+			size = formatBytes(q.Size)
+		}
+		if q.Duration > 0 {
+			duration = formatClock(q.Duration)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", q.Resolution, available, size, duration)
+	}
+	w.Flush()
+}
+
+// anyAvailable reports whether the video is available in any quality
+func anyAvailable(qualities []kdramadl.Quality) bool {
+	for _, q := range qualities {
+		if q.Available {
+			return true
+		}
+	}
+	return false
+}
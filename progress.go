@@ -0,0 +1,169 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+	isatty "github.com/mattn/go-isatty"
+)
+
+// progressBarWidth is the number of characters inside the progress bar
+const progressBarWidth = 30
+
+// progressLogInterval is how often progress is logged when there is no bar
+var progressLogInterval = 10 * time.Second
+
+// barVisible is set while a progress bar is on the current line,
+// so that the logger knows to move to a new line first. Guarded by logMutex.
+var barVisible bool
+
+// showProgress returns a handler for Downloader.OnProgress. In json mode
+// progress events are emitted. Otherwise a progress bar is drawn when stdout
+// is a terminal and only one download runs at a time, or else progress is
+// logged periodically through the job's logger.
+func showProgress(parallel bool) func(kdramadl.Job, kdramadl.Progress) {
+	if outputMode == outputJSON {
+		return emitProgress
+	}
+	fd := os.Stdout.Fd()
+	if !parallel && (isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)) {
+		return drawProgressBar
+	}
+
+	var mu sync.Mutex
+	lastLog := map[string]time.Time{}
+	return func(j kdramadl.Job, p kdramadl.Progress) {
+		key := fmt.Sprintf("%v/%v %v", j.Folder, j.FileName, p.Stage)
+		mu.Lock()
+		if !p.Done && time.Since(lastLog[key]) < progressLogInterval {
+			mu.Unlock()
+			return
+		}
+		lastLog[key] = time.Now()
+		if p.Done {
+			delete(lastLog, key)
+		}
+		mu.Unlock()
+
+		jobLogger(j).Infof("%v %v", stageName(p.Stage), formatProgress(p))
+	}
+}
+
+// lastBarWidth is the length of the last bar drawn so that a shorter one
+// can blank out what is left of it. Guarded by logMutex.
+var lastBarWidth int
+
+// drawProgressBar redraws the progress bar on the current line
+func drawProgressBar(j kdramadl.Job, p kdramadl.Progress) {
+	fraction := p.Fraction()
+	filled := 0
+	if fraction > 0 {
+		filled = int(fraction * progressBarWidth)
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		if fraction >= 0 {
+			bar += ">"
+		}
+		bar += strings.Repeat(" ", progressBarWidth-len(bar))
+	}
+	line := fmt.Sprintf("%-11v [%v] %v", stageName(p.Stage), bar, formatProgress(p))
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	padding := ""
+	if len(line) < lastBarWidth {
+		padding = strings.Repeat(" ", lastBarWidth-len(line))
+	}
+	lastBarWidth = len(line)
+	fmt.Print("\r" + line + padding)
+	barVisible = true
+	if p.Done {
+		fmt.Println()
+		barVisible = false
+		lastBarWidth = 0
+	}
+}
+
+func stageName(stage string) string {
+	if stage == kdramadl.StageDownload {
+		return "Downloading"
+	}
+	return "Processing"
+}
+
+// formatProgress describes the progress as percentage, speed, ETA and size
+func formatProgress(p kdramadl.Progress) string {
+	var parts []string
+	if fraction := p.Fraction(); fraction >= 0 {
+		parts = append(parts, fmt.Sprintf("%5.1f%%", fraction*100))
+	}
+	if p.Stage == kdramadl.StageFFmpeg && p.Position > 0 {
+		position := formatClock(p.Position)
+		if p.Duration > 0 {
+			position += "/" + formatClock(p.Duration)
+		}
+		parts = append(parts, position)
+	}
+	if !p.Done {
+		parts = append(parts, fmt.Sprintf("%v/s", formatBytes(int64(p.Rate))))
+		if eta := p.ETA(); eta >= 0 {
+			parts = append(parts, "ETA "+formatClock(eta))
+		}
+	} else {
+		parts = append(parts, "in "+formatClock(p.Elapsed))
+	}
+	size := formatBytes(p.Bytes)
+	if p.Total > 0 && !p.Done {
+		size += " of " + formatBytes(p.Total)
+	}
+	parts = append(parts, size)
+	return strings.Join(parts, "  ")
+}
+
+// formatBytes formats a size with binary units, e.g. 12.3 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	value := float64(n)
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %v", value, units[i])
+}
+
+// formatClock formats a duration as mm:ss, or hh:mm:ss if an hour or more
+func formatClock(t time.Duration) string {
+	seconds := int64(t.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+// parseOffset parses a subtitle offset such as "1.5s", "-2s", "-500ms"
+// or a number of seconds
+func parseOffset(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		// NaN, infinity and anything past the range of time.Duration
+		if math.IsNaN(seconds) || math.Abs(seconds) >= math.MaxInt64/float64(time.Second) {
+			return 0, fmt.Errorf("Invalid subtitle offset: %v", s)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	offset, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid subtitle offset: %v", s)
+	}
+	return offset, nil
+}
+
+// parseScale parses a subtitle scale such as "1.001" or a framerate
+// ratio such as "25/23.976"
+func parseScale(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 1, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	scale, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err == nil && len(parts) == 2 {
+		var divisor float64
+		divisor, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if divisor == 0 {
+			err = fmt.Errorf("division by zero")
+		}
+		scale /= divisor
+	}
+	if err != nil || !(scale > 0) || math.IsInf(scale, 0) {
+		return 0, fmt.Errorf("Invalid subtitle scale: %v", s)
+	}
+	return scale, nil
+}
+
+// shiftSubtitles changes the times in a SubRip file in place. The file is
+// repaired too since it is rewritten anyway.
+func shiftSubtitles(path string, offset time.Duration, scale float64) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	subs, repairs, err := kdramadl.RepairSRT(data)
+	if err != nil {
+		return fmt.Errorf("Error reading %v: %v", path, err)
+	}
+	for _, repair := range repairs {
+		logger.Warningf("%v: %v", path, repair)
+	}
+	removed := subs.Shift(offset, scale)
+	if removed > 0 {
+		logger.Warningf("%v: removed the cues that ended before the video starts (%v)", path, removed)
+	}
+	var shifted bytes.Buffer
+	if err := subs.WriteSRT(&shifted); err != nil {
+		return err
+	}
+	// write to a temporary file first so that a failed write does not
+	// lose the subtitles
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, shifted.Bytes(), 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	logger.Infof("Shifted %v cues in %v by %v, scaled by %v", len(subs.Cues), path, offset, scale)
+	return nil
+}
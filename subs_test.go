@@ -0,0 +1,82 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseOffset(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, true},
+		{"1.5", 1500 * time.Millisecond, true},
+		{" -2 ", -2 * time.Second, true},
+		{"1.5s", 1500 * time.Millisecond, true},
+		{"-500ms", -500 * time.Millisecond, true},
+		{"1m30s", 90 * time.Second, true},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"-inf", 0, false},
+		{"1e10", 0, false},
+		{"-1e10", 0, false},
+		{"1e400", 0, false},
+		{"9999999999h", 0, false},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseOffset(test.s)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("parseOffset(%q) = %v, %v, want %v", test.s, got, err, test.want)
+		} else if !test.ok && err == nil {
+			t.Errorf("parseOffset(%q) = %v, want an error", test.s, got)
+		}
+	}
+}
+
+func TestParseScale(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+		ok   bool
+	}{
+		{"", 1, true},
+		{"1.001", 1.001, true},
+		{"25/25", 1, true},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"1/0", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"1/inf", 0, false},
+		{"fast", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseScale(test.s)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("parseScale(%q) = %v, %v, want %v", test.s, got, err, test.want)
+		} else if !test.ok && err == nil {
+			t.Errorf("parseScale(%q) = %v, want an error", test.s, got)
+		}
+	}
+}
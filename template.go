@@ -0,0 +1,236 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+// metadata describes the episode a job downloads, for naming its files
+// and tagging the video
+type metadata struct {
+	Series   string
+	Season   *int
+	Episode  *int
+	FileName string // the filename given before the template is applied
+
+	Title            string // defaults to the filename
+	Date             string
+	AudioLanguage    string
+	SubtitleLanguage string
+	AudioTitle       string
+	SubtitleTitle    string
+}
+
+// tags returns the tags written into the container of job j
+func (m metadata) tags(j kdramadl.Job) kdramadl.Tags {
+	t := kdramadl.Tags{
+		Title:            m.Title,
+		Show:             m.Series,
+		Season:           m.Season,
+		Episode:          m.Episode,
+		Date:             m.Date,
+		AudioLanguage:    m.AudioLanguage,
+		AudioTitle:       m.AudioTitle,
+		SubtitleLanguage: m.SubtitleLanguage,
+		SubtitleTitle:    m.SubtitleTitle,
+	}
+	if t.Title == "" {
+		t.Title = filepath.Base(j.FileName)
+	}
+	return t
+}
+
+// templateFields are the names that can be used in an output template
+var templateFields = []string{"series", "season", "episode", "resolution", "ext", "code", "filename"}
+
+// templatePart is either literal text or a field with an optional zero padded width
+type templatePart struct {
+	text  string
+	field string
+	width int
+}
+
+// outputTemplate builds the filename of a job, e.g.
+// "{series}/Season {season}/{series} - E{episode:02} [{resolution}].{ext}"
+type outputTemplate struct {
+	parts []templatePart
+}
+
+// parseTemplate checks the fields of a template
+func parseTemplate(s string) (*outputTemplate, error) {
+	t := &outputTemplate{}
+	for s != "" {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			t.parts = append(t.parts, templatePart{text: s})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{text: s[:start]})
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("Invalid output template: missing } after %q", s[start:])
+		}
+		part := templatePart{field: s[start+1 : start+end]}
+		if i := strings.IndexByte(part.field, ':'); i >= 0 {
+			spec := part.field[i+1:]
+			part.field = part.field[:i]
+			width, err := strconv.Atoi(spec)
+			if err != nil || width < 1 || !strings.HasPrefix(spec, "0") {
+				return nil, fmt.Errorf("Invalid output template: {%v:%v} must be a width such as {%v:02}", part.field, spec, part.field)
+			}
+			if part.field != "season" && part.field != "episode" {
+				return nil, fmt.Errorf("Invalid output template: only {season} and {episode} can be padded")
+			}
+			part.width = width
+		}
+		if !stringInSlice(part.field, templateFields) {
+			return nil, fmt.Errorf("Invalid output template: unknown field {%v}, choose from {%v}",
+				part.field, strings.Join(templateFields, "} {"))
+		}
+		t.parts = append(t.parts, part)
+		s = s[start+end+1:]
+	}
+	return t, nil
+}
+
+// render returns the filename for a job without the extension.
+// Folders in the template are separated by / and the extension is
+// always the job's format, so a trailing .{ext} is dropped.
+func (t *outputTemplate) render(j kdramadl.Job, m metadata) (string, error) {
+	format := j.Format
+	if format == "" {
+		format = kdramadl.Formats[0]
+	}
+	var name strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			name.WriteString(part.text)
+			continue
+		}
+		var value string
+		switch part.field {
+		case "series":
+			value = m.Series
+		case "season", "episode":
+			number := m.Season
+			if part.field == "episode" {
+				number = m.Episode
+			}
+			if number != nil {
+				value = fmt.Sprintf("%0*d", part.width, *number)
+			}
+		case "resolution":
+			value = j.Resolution
+		case "ext":
+			value = format
+		case "code":
+			value = j.Code
+		case "filename":
+			value = m.FileName
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return "", fmt.Errorf("The output template uses {%v} but it is not set", part.field)
+		}
+		// a value cannot add folders
+		name.WriteString(strings.Map(func(r rune) rune {
+			if isSeparator(r) {
+				return '_'
+			}
+			return r
+		}, value))
+	}
+
+	var components []string
+	for _, c := range strings.FieldsFunc(name.String(), isSeparator) {
+		if c = sanitizeFileName(c); c != "" {
+			components = append(components, c)
+		}
+	}
+	if len(components) == 0 {
+		return "", fmt.Errorf("The output template gives an empty filename")
+	}
+	fileName := filepath.Join(components...)
+	return strings.TrimSuffix(fileName, "."+format), nil
+}
+
+// isSeparator reports whether r separates folders in a template
+func isSeparator(r rune) bool {
+	return r == '/' || (runtime.GOOS == "windows" && r == '\\')
+}
+
+// reservedNames cannot be used as file names on Windows, with or without an extension
+var reservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// sanitizeFileName replaces the characters that are not allowed in a file
+// or folder name on this OS with _
+func sanitizeFileName(name string) string {
+	illegal := "\x00"
+	switch runtime.GOOS {
+	case "windows":
+		illegal = "<>:\"|?*\x00"
+	case "darwin":
+		illegal = ":\x00"
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(illegal, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if runtime.GOOS == "windows" {
+		// Windows drops trailing dots and spaces
+		name = strings.TrimRight(name, ". ")
+		base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if stringInSlice(base, reservedNames) {
+			name = "_" + name
+		}
+	}
+	if name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// parseNumber parses an optional season or episode number
+func parseNumber(name string, s string) (*int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid %v number: %v", name, s)
+	}
+	return &n, nil
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2017 github.com/lastmodified
+//
+// This file is part of kdramadl.
+//
+// kdramadl is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kdramadl is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kdramadl.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/lastmodified/kdramadl/kdramadl"
+)
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct{ template, err string }{
+		{"{series}/Season {season:02}/{series} - E{episode:02} [{resolution}].{ext}", ""},
+		{"{code} {filename}", ""},
+		{"no fields", ""},
+		{"{title}", "unknown field {title}"},
+		{"{series", "missing }"},
+		{"{episode:2}", "must be a width"},
+		{"{episode:0}", "must be a width"},
+		{"{series:02}", "only {season} and {episode} can be padded"},
+	}
+	for _, test := range tests {
+		_, err := parseTemplate(test.template)
+		if test.err == "" && err != nil {
+			t.Errorf("%q: %v", test.template, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: got error %v, want %q", test.template, err, test.err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	season, episode := 1, 3
+	m := metadata{Series: "Goblin", Season: &season, Episode: &episode, FileName: "goblin-e03"}
+	j := kdramadl.Job{Code: "abc", Resolution: "720p", Format: kdramadl.FormatMP4}
+	tests := []struct {
+		name     string
+		template string
+		m        metadata
+		want     string
+		err      string
+	}{
+		{"fields", "{series}/Season {season}/{series} - E{episode:02} [{resolution}] {code}", m,
+			filepath.Join("Goblin", "Season 1", "Goblin - E03 [720p] abc"), ""},
+		{"extension dropped", "{filename}.{ext}", m, "goblin-e03", ""},
+		{"extension kept elsewhere", "{ext}/{filename}", m, filepath.Join("mp4", "goblin-e03"), ""},
+		{"wide padding", "E{episode:003}", m, "E003", ""},
+		{"unset field", "{series} {season}", metadata{Series: "Goblin"}, "", "uses {season} but it is not set"},
+		{"blank field", "{series}", metadata{Series: " "}, "", "uses {series} but it is not set"},
+		{"value cannot add folders", "{series}/{filename}", metadata{Series: "../../etc", FileName: "a/b"},
+			filepath.Join(".._.._etc", "a_b"), ""},
+		{"no traversal", "../{filename}/./..", m, filepath.Join("_", "goblin-e03", "_", "_"), ""},
+		{"no absolute path", "/{filename}", m, "goblin-e03", ""},
+		{"empty", "/", m, "", "empty filename"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template, err := parseTemplate(test.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := template.render(j, test.m)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got %q and error %v, want %q", got, err, test.err)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("got %q and error %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct{ name, unix, darwin, windows string }{
+		{`a\b:c*d?e"f<g>h|i`, `a\b:c*d?e"f<g>h|i`, `a\b_c*d?e"f<g>h|i`, `a\b_c_d_e_f_g_h_i`},
+		{"tab\there", "tab_here", "tab_here", "tab_here"},
+		{" spaced ", "spaced", "spaced", "spaced"},
+		{"dots...", "dots...", "dots...", "dots"},
+		{"CON.mkv", "CON.mkv", "CON.mkv", "_CON.mkv"},
+		{"..", "_", "_", "_"},
+		{".", "_", "_", "_"},
+	}
+	for _, test := range tests {
+		want := test.unix
+		switch runtime.GOOS {
+		case "windows":
+			want = test.windows
+		case "darwin":
+			want = test.darwin
+		}
+		if got := sanitizeFileName(test.name); got != want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", test.name, got, want)
+		}
+	}
+}